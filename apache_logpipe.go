@@ -6,8 +6,6 @@ import (
 	goflag "flag"
 	"os"
 	"os/signal"
-	"regexp"
-	"strconv"
 	"syscall"
 	"time"
 
@@ -23,52 +21,54 @@ var discoveryInterval int
 var zabbixServer string
 var zabbixHost string
 
-func parseInput(logSink processing.LogSink, requestAccounting processing.RequestAccounting, cfg processing.Configuration) {
-
-	scanner := bufio.NewScanner(os.Stdin)
+func parseInput(logSink *processing.LogSink, requestAccounting processing.RequestAccounting, cfg processing.Configuration) {
 
 	var lines int64 = 0
 	var linesNotMatched int64 = 0
 	timeStart := time.Now()
-	lineRe := regexp.MustCompile(cfg.RegexLogLineString)
+	parser, err := processing.NewLogLineParser(cfg)
+	if err != nil {
+		glog.Fatalf("unable to create logline parser: %s", err.Error())
+	}
 
-	for scanner.Scan() {
-		line := scanner.Text()
+	handleLine := func(line string) {
 		lines++
 		logSink.SubmitLogLine(line)
-		match := lineRe.FindStringSubmatch(line)
-		if len(match) == 0 {
+		perfSet, ok := parser.Parse(line)
+		if !ok {
 			glog.V(1).Infof("not matched line: %s\n", line)
 			linesNotMatched++
-			continue
-		}
-		result := make(map[string]string)
-		for i, name := range lineRe.SubexpNames() {
-			if i != 0 && name != "" {
-				result[name] = match[i]
-			}
+			return
 		}
 
-		code, err := strconv.Atoi(result["code"])
-		if err != nil {
-			glog.Fatalf("unable to convert code '%s' to integer", result["code"])
-		}
-		if code >= 400 || code < 200 {
-			linesNotMatched++
-			continue
-		}
+		processing.PerfSetChan <- perfSet
+	}
 
-		processing.PerfSetChan <- processing.PerfSet{
-			Domain: result["domain"],
-			Ident:  result["uri"],
-			Time:   result["time"],
-			Code:   code,
+	if len(cfg.FollowFiles) > 0 {
+		// runs until the process is terminated by a signal, the offsets are persisted when the lines are accounted
+		follower := processing.NewFileFollower(cfg.FollowFiles, cfg.FollowStateFile, 250*time.Millisecond)
+		follower.SetCheckpoint(processing.SyncStream)
+		stopChan := make(chan os.Signal, 1)
+		signal.Notify(stopChan, syscall.SIGINT, syscall.SIGTERM)
+		go func() {
+			received := <-stopChan
+			glog.Infof("got %s signal, stopping to follow files", received)
+			follower.Stop()
+		}()
+		follower.Follow(handleLine)
+	} else {
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			handleLine(scanner.Text())
 		}
 	}
+	// submit the last statistics and write the accounting state when apache closes the pipe or following was stopped
+	processing.CompleteStream()
+	<-processing.CompleteChan
 	linesAccounted := logSink.CloseLogStream()
 	glog.V(1).Infof("Accounted %d lines", linesAccounted)
 	if linesAccounted != lines-linesNotMatched {
-		glog.Errorf("Accounted lines are not equal to matched lines (total lines: %d, lines not matched: %d ( 200 < http code, http code  >=400), lines accounted: %d)",
+		glog.Errorf("Accounted lines are not equal to matched lines (total lines: %d, lines not matched: %d, lines accounted: %d)",
 			lines, linesNotMatched, linesAccounted)
 	}
 
@@ -78,6 +78,32 @@ func parseInput(logSink processing.LogSink, requestAccounting processing.Request
 	glog.Infof("Processed %d lines in %s, %f lines per second, %d lines not matched (%0.2f%%)\n", lines, elapsed, linesPerSecond, linesNotMatched, percentageNotMatched)
 }
 
+// analyzeBatch accounts the given logfiles or stdin in time buckets and writes a report to stdout
+func analyzeBatch(files []string, cfg processing.Configuration) {
+	timeStart := time.Now()
+	batch, err := processing.NewBatchAnalysis(cfg, cfg.BatchBucket)
+	if err != nil {
+		glog.Fatalf("unable to start batch analysis: %s", err.Error())
+	}
+	if len(files) == 0 {
+		err = batch.Process(os.Stdin)
+		if err != nil {
+			glog.Fatalf("unable to read stdin: %s", err.Error())
+		}
+	}
+	for _, file := range files {
+		err = batch.ProcessFile(file)
+		if err != nil {
+			glog.Fatalf("unable to analyze logfile %s: %s", file, err.Error())
+		}
+	}
+	err = batch.WriteReport(os.Stdout, cfg.ReportFormat)
+	if err != nil {
+		glog.Fatalf("unable to write report: %s", err.Error())
+	}
+	glog.Infof("Analyzed %d lines in %s, %d lines not matched\n", batch.Lines, time.Since(timeStart), batch.LinesNotMatched)
+}
+
 func main() {
 
 	cfg := processing.NewConfiguration()
@@ -88,17 +114,55 @@ func main() {
 	var configFile string = ""
 	var showStats bool = false
 	var dumpStats bool = false
+	var batchMode bool = false
 	flag.CommandLine.AddGoFlagSet(goflag.CommandLine)
 
 	flag.StringVar(&configFile, "config", configFile, "Name of the config file")
 	flag.StringVar(&cfg.OutputLogfile, "output_logfile", cfg.OutputLogfile, "Filename with timestamp, i.e. '/var/log/apache2/access.log.%Y-%m-%d'")
 	flag.StringVar(&cfg.OutputLogfileSymlink, "symlink", cfg.OutputLogfileSymlink, "A symlink which points to the current logfile")
+	flag.StringVar(&cfg.Compress, "compress", cfg.Compress, "Compress logfiles after rotation: none, gzip or zstd")
+	flag.BoolVar(&cfg.CompressInline, "compress_inline", cfg.CompressInline, "Write logfiles compressed from the start instead of compressing them after rotation")
+	flag.DurationVar(&cfg.RetentionMaxAge, "max_age", cfg.RetentionMaxAge, "Remove logfiles created by the output_logfile pattern which are older than this duration, i.e. '336h'")
+	flag.IntVar(&cfg.RetentionMaxFiles, "max_files", cfg.RetentionMaxFiles, "Keep at most this number of logfiles created by the output_logfile pattern")
+	flag.Int64Var(&cfg.RetentionMaxTotalBytes, "max_total_bytes", cfg.RetentionMaxTotalBytes, "Keep at most this number of bytes of logfiles created by the output_logfile pattern")
+	flag.StringVar(&cfg.LogFormat, "log_format", cfg.LogFormat, "Apache LogFormat string of the loglines or the name of a preset, i.e. 'vhost_combined_canonical' (overrides regex_logline)")
+	flag.StringSliceVar(&cfg.FollowFiles, "follow", cfg.FollowFiles, "Follow the given logfiles like 'tail -F' instead of reading stdin")
+	flag.StringVar(&cfg.FollowStateFile, "follow_state_file", cfg.FollowStateFile, "A file which stores the read offsets of followed logfiles across restarts")
+	flag.StringVar(&cfg.InputFormat, "input_format", cfg.InputFormat, "Format of the loglines: text (log_format or regex_logline) or json")
+	flag.StringVar(&cfg.TimeUnit, "time_unit", cfg.TimeUnit, "Unit of the time values parsed by regex_logline or json: s, ms, us or ns (fractional values are supported)")
+	flag.BoolVar(&batchMode, "batch", false, "Analyze the logfiles given as arguments (or stdin) offline and write a report, gzip and zstd compressed files are supported")
+	flag.StringVar(&cfg.BatchBucket, "bucket", cfg.BatchBucket, "Time buckets of the batch analysis: hour or day")
+	flag.StringVar(&cfg.ReportFormat, "report_format", cfg.ReportFormat, "Format of the batch analysis report: table, csv or json")
+	flag.BoolVar(&cfg.LogClock, "log_clock", cfg.LogClock, "Aggregate the statistics by the timestamps of the loglines and send them with that clock, useful for catching up or replaying logfiles")
+	flag.Float64SliceVar(&cfg.Percentiles, "percentiles", cfg.Percentiles, "Percentiles of the response times which are calculated per sending interval")
+	flag.StringSliceVar(&cfg.LatencyCodeClasses, "latency_code_classes", cfg.LatencyCodeClasses, "Http code classes which are included in the latency statistics, i.e. '2xx,3xx'")
+	flag.StringSliceVar(&cfg.ErrorCodeClasses, "error_code_classes", cfg.ErrorCodeClasses, "Http code classes which are counted as errors, i.e. '5xx'")
+	flag.StringVar(&cfg.RequestMappingMode, "request_mapping_mode", cfg.RequestMappingMode, "Account a request in all matching request mappings (all) or only in the first one (first)")
+	flag.IntVar(&cfg.MaxMappingNames, "max_mapping_names", cfg.MaxMappingNames, "Maximum number of accounting set names per vhost created by a request mapping name template")
+	flag.BoolVar(&cfg.VhostStripPort, "vhost_strip_port", cfg.VhostStripPort, "Remove the port of vhosts, i.e. 'foo.bar.com:443' is accounted as 'foo.bar.com'")
+	flag.BoolVar(&cfg.VhostLowercase, "vhost_lowercase", cfg.VhostLowercase, "Account vhosts by their lowercase names")
+	flag.BoolVar(&cfg.VhostCollapseWWW, "vhost_collapse_www", cfg.VhostCollapseWWW, "Account 'www.foo.bar.com' as 'foo.bar.com'")
+	flag.StringVar(&cfg.AccountingStateFile, "accounting_state_file", cfg.AccountingStateFile, "A file which stores the lifetime counters of the statistics across restarts")
+	flag.DurationVar(&cfg.IdleTTL, "idle_ttl", cfg.IdleTTL, "Remove accounting sets without requests for this duration from the statistics and the discovery, their counters restart at 0 with the next request, i.e. '24h' (0 keeps them forever)")
+	flag.IntVar(&cfg.MaxVhosts, "max_vhosts", cfg.MaxVhosts, "Maximum number of vhosts, requests of further vhosts are accounted in the vhost 'overflow' (0 disables the limit)")
+	flag.IntVar(&cfg.MaxAccsetsPerVhost, "max_accsets_per_vhost", cfg.MaxAccsetsPerVhost, "Maximum number of accounting sets per vhost, further requests are accounted in the accounting set 'other' (0 disables the limit)")
+	flag.StringSliceVar(&cfg.VhostAllowlist, "vhost_allowlist", cfg.VhostAllowlist, "Glob patterns of vhosts which are accounted, requests of other vhosts are accounted in the vhost 'overflow'")
+	flag.StringSliceVar(&cfg.VhostDenylist, "vhost_denylist", cfg.VhostDenylist, "Glob patterns of vhosts whose requests are not accounted")
 	flag.IntVar(&cfg.SendingInterval, "sending_interval", cfg.SendingInterval, "Sending interval in seconds")
 	flag.IntVar(&cfg.Timeout, "timeout", cfg.Timeout, "timeout in seconds (default: 5 seconds)")
 	flag.IntVar(&cfg.DiscoveryInterval, "discovery_interval", cfg.DiscoveryInterval, "Discovery interval in seconds")
-	flag.StringVar(&cfg.ZabbixServer, "zabbix_server", cfg.ZabbixServer, "The hostname of the zabbix server")
+	flag.StringVar(&cfg.ZabbixServer, "zabbix_server", cfg.ZabbixServer, "The hostname of the zabbix server, optionally with a port like 'zabbix:10052' (default 10051)")
 	flag.StringVar(&cfg.ZabbixHost, "zabbix_host", cfg.ZabbixHost, "The zabbix host to report data for")
 	flag.BoolVar(&cfg.ZabbixSendDisabled, "disable_zabbix", false, "Disable zabbix sender")
+	flag.IntVar(&cfg.ZabbixSpoolSize, "zabbix_spool_size", cfg.ZabbixSpoolSize, "Maximum number of zabbix packets which are kept for a retry after a failed delivery")
+	flag.StringVar(&cfg.ZabbixSpoolDir, "zabbix_spool_dir", cfg.ZabbixSpoolDir, "A directory which stores the undelivered zabbix packets across restarts")
+	flag.DurationVar(&cfg.ZabbixRetryBackoff, "zabbix_retry_backoff", cfg.ZabbixRetryBackoff, "Delay of the first retry of a failed zabbix delivery, doubled with every failed retry up to 10 minutes")
+	flag.StringSliceVar(&cfg.Exporters, "exporters", cfg.Exporters, "Comma separated list of exporters which receive the statistics: zabbix, statsd, influxdb")
+	flag.StringVar(&cfg.InfluxURL, "influxdb_url", cfg.InfluxURL, "The influxdb write api url, i.e. 'http://influxdb:8086/api/v2/write?org=myorg&bucket=apache'")
+	flag.StringVar(&cfg.InfluxFile, "influxdb_file", cfg.InfluxFile, "A file which receives the statistics in the influxdb line protocol")
+	flag.StringVar(&cfg.StatsdServer, "statsd_server", cfg.StatsdServer, "The statsd server address, i.e. '127.0.0.1:8125'")
+	flag.BoolVar(&cfg.WebInterfaceEnable, "webinterface_enable", cfg.WebInterfaceEnable, "Serve statistics (/getStatus) and prometheus metrics (/metrics) by http")
+	flag.StringVar(&cfg.WebInterfaceListen, "webinterface_listen", cfg.WebInterfaceListen, "The listen address of the webinterface")
 	flag.BoolVar(&showStats, "show_stats_debug", false, "Show stats for debugging purposes")
 	flag.BoolVar(&dumpStats, "dump_stats", false, "Dump stats")
 	goflag.Set("logtostderr", "true")
@@ -108,13 +172,22 @@ func main() {
 
 	cfg.LoadFile(configFile)
 
+	if batchMode {
+		analyzeBatch(flag.Args(), *cfg)
+		return
+	}
+
 	glog.Infof("Starting apache_logpipe: output_logfile: %s, sending_interval: %d, discovery_interval: %d, zabbix_server: %s, zabbix_host: %s\n",
 		cfg.OutputLogfile, cfg.SendingInterval, cfg.DiscoveryInterval, cfg.ZabbixServer, cfg.ZabbixHost)
 
-	// Install signal handler
-	signal.Notify(processing.SignalChan, syscall.SIGINT, syscall.SIGTERM)
+	// Install signal handler, followed files are stopped by parseInput to drain the accounting in order
+	if len(cfg.FollowFiles) == 0 {
+		signal.Notify(processing.SignalChan, syscall.SIGINT, syscall.SIGTERM)
+	}
 
-	logSink := *processing.NewLogSink(cfg.OutputLogfile, cfg.OutputLogfileSymlink)
+	logSink := processing.NewLogSink(cfg.OutputLogfile, cfg.OutputLogfileSymlink)
+	logSink.SetCompression(cfg.Compress, cfg.CompressInline)
+	logSink.SetRetention(cfg.RetentionMaxAge, cfg.RetentionMaxFiles, cfg.RetentionMaxTotalBytes)
 
 	requestAccounting := processing.NewRequestAccounting(*cfg)
 	requestAccounting.DisableZabbixSender(cfg.ZabbixSendDisabled)
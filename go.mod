@@ -7,6 +7,7 @@ require (
 	github.com/davecgh/go-spew v1.1.1
 	github.com/goji/httpauth v0.0.0-20160601135302-2da839ab0f4d
 	github.com/golang/glog v1.0.0
+	github.com/klauspost/compress v1.15.15
 	github.com/lestrrat-go/strftime v1.0.6
 	github.com/olekukonko/tablewriter v0.0.5
 	github.com/spf13/pflag v1.0.5
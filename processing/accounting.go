@@ -3,15 +3,15 @@ package processing
 import (
 	"encoding/json"
 	"fmt"
+	"io"
+	"math"
 	"os"
 	"regexp"
 	"sort"
 	"strconv"
-	"strings"
 	"sync"
 	"time"
 
-	. "github.com/blacked/go-zabbix"
 	"github.com/golang/glog"
 	"github.com/olekukonko/tablewriter"
 )
@@ -21,189 +21,531 @@ var PerfSetChan = make(chan PerfSet, 100)
 
 // PerfSet is used to send accounting datasets over the PerfSet channel
 type PerfSet struct {
-	Domain string
-	Ident  string
-	Time   string
-	Code   int
+	Domain    string
+	Ident     string
+	Time      string
+	Code      int
+	Timestamp string
 }
 
+// timestampLayouts are the supported layouts of request timestamps, the apache %t format is tried first
+var timestampLayouts = []string{
+	"02/Jan/2006:15:04:05 -0700",
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05",
+}
+
+// ParseTimestamp converts the timestamp of a logline, unix epoch seconds are supported as well
+func ParseTimestamp(timestamp string) (time.Time, error) {
+	for _, layout := range timestampLayouts {
+		if result, err := time.Parse(layout, timestamp); err == nil {
+			return result, nil
+		}
+	}
+	if epoch, err := strconv.ParseFloat(timestamp, 64); err == nil {
+		seconds := math.Floor(epoch)
+		return time.Unix(int64(seconds), int64((epoch-seconds)*1e9)), nil
+	}
+	return time.Time{}, fmt.Errorf("unable to parse timestamp '%s'", timestamp)
+}
+
+// CodeClass returns the class of a http code, i.e. "5xx"
+func CodeClass(code int) string {
+	return fmt.Sprintf("%dxx", code/100)
+}
+
+var regexCodeClass = regexp.MustCompile(`^[1-5]xx$`)
+
+// newCodeClassSet validates a list of code classes like "2xx, 3xx"
+func newCodeClassSet(codeClasses []string) (map[string]bool, error) {
+	result := map[string]bool{}
+	for _, codeClass := range codeClasses {
+		if !regexCodeClass.MatchString(codeClass) {
+			return nil, fmt.Errorf("invalid http code class '%s', expected 1xx, 2xx, 3xx, 4xx or 5xx", codeClass)
+		}
+		result[codeClass] = true
+	}
+	return result, nil
+}
+
+// UnmatchedAccset is the accounting set of requests which match no request mapping
+const UnmatchedAccset = "unmatched"
+
 // accountingSet for a certain request type
 type accountingSet struct {
-	Count     int64
-	lastCount int64
-	Sum       int64
-	lastSum   int64
-	Codes     map[int]int64
-	Classes   map[int]int64
+	// Count, Sum and Classes contain the requests which are included in the latency statistics
+	Count   int64
+	Sum     int64
+	Classes map[int]int64
+	// Requests, Errors, Codes and CodeClasses contain all requests
+	Requests    int64
+	Errors      int64
+	Codes       map[int]int64
+	CodeClasses map[string]int64
+	// Percentiles of the response times of the last sending interval
+	Percentiles map[string]int64
+	latencies   *latencyHistogram
+	// Interval contains the statistics of the last sending interval
+	Interval *intervalSet
+	current  *intervalSet
+	// LastSeen is the time of the last request, idle accounting sets expire after the idle_ttl
+	LastSeen time.Time
+}
+
+// intervalSet contains the statistics of a single sending interval
+type intervalSet struct {
+	Count int64
+	Sum   int64
+	// Average response time in microseconds
+	Average float64
+	Max     int64
+	Classes map[int]int64
+	// RequestsPerSecond is the rate of all requests during the elapsed time of the interval
+	RequestsPerSecond float64
+	Requests          int64
+	Errors            int64
+	// ErrorRatio is the fraction of requests with a error code class
+	ErrorRatio  float64
+	Codes       map[int]int64
+	CodeClasses map[string]int64
+}
+
+func newIntervalSet(classes []int) *intervalSet {
+	result := &intervalSet{
+		Codes:       make(map[int]int64),
+		Classes:     make(map[int]int64),
+		CodeClasses: make(map[string]int64),
+	}
+	for _, perfclass := range classes {
+		result.Classes[perfclass] = 0
+	}
+	return result
+}
+
+func (c *intervalSet) addRequest(code int, isError bool) {
+	c.Requests++
+	c.Codes[code]++
+	c.CodeClasses[CodeClass(code)]++
+	if isError {
+		c.Errors++
+	}
+}
+
+func (c *intervalSet) addLatency(responsetime int64, perfclass int) {
+	c.Count++
+	c.Sum += responsetime
+	if responsetime > c.Max {
+		c.Max = responsetime
+	}
+	c.Classes[perfclass]++
+}
+
+func (c *intervalSet) copy() *intervalSet {
+	result := *c
+	result.Codes = make(map[int]int64, len(c.Codes))
+	for code, count := range c.Codes {
+		result.Codes[code] = count
+	}
+	result.Classes = make(map[int]int64, len(c.Classes))
+	for class, count := range c.Classes {
+		result.Classes[class] = count
+	}
+	result.CodeClasses = make(map[string]int64, len(c.CodeClasses))
+	for codeClass, count := range c.CodeClasses {
+		result.CodeClasses[codeClass] = count
+	}
+	return &result
+}
+
+func (c *accountingSet) copy() *accountingSet {
+	result := *c
+	result.Codes = make(map[int]int64, len(c.Codes))
+	for code, count := range c.Codes {
+		result.Codes[code] = count
+	}
+	result.Classes = make(map[int]int64, len(c.Classes))
+	for class, count := range c.Classes {
+		result.Classes[class] = count
+	}
+	result.CodeClasses = make(map[string]int64, len(c.CodeClasses))
+	for codeClass, count := range c.CodeClasses {
+		result.CodeClasses[codeClass] = count
+	}
+	result.Percentiles = make(map[string]int64, len(c.Percentiles))
+	for name, value := range c.Percentiles {
+		result.Percentiles[name] = value
+	}
+	result.latencies = nil
+	result.Interval = c.Interval.copy()
+	result.current = nil
+	return &result
+}
+
+// finishInterval completes the statistics of the current sending interval and starts the next one
+func (c *accountingSet) finishInterval(percentiles []float64, classes []int, elapsed time.Duration) {
+	c.updatePercentiles(percentiles, true)
+	c.Interval = c.current
+	if c.Interval.Count > 0 {
+		c.Interval.Average = float64(c.Interval.Sum) / float64(c.Interval.Count)
+	}
+	if c.Interval.Requests > 0 {
+		c.Interval.ErrorRatio = float64(c.Interval.Errors) / float64(c.Interval.Requests)
+	}
+	if elapsed > 0 {
+		c.Interval.RequestsPerSecond = float64(c.Interval.Requests) / elapsed.Seconds()
+	}
+	// codes which did not occur in this interval are reported with zero
+	for code := range c.Codes {
+		c.Interval.Codes[code] += 0
+	}
+	for codeClass := range c.CodeClasses {
+		c.Interval.CodeClasses[codeClass] += 0
+	}
+	c.current = newIntervalSet(classes)
 }
 
-type zabbixConfigSetting struct {
-	Server       string
-	ServerPort   int
-	Host         string
-	DiscoveryKey string
-	BaseKey      string
-	Disabled     bool
+// updatePercentiles estimates the percentiles of the recorded response times,
+// reset starts recording the next sending interval
+func (c *accountingSet) updatePercentiles(percentiles []float64, reset bool) {
+	c.Percentiles = c.latencies.quantiles(percentiles)
+	if reset {
+		c.latencies.reset()
+	}
 }
 
 // RequestAccounting account requests delivered by PerfSetChan
 type RequestAccounting struct {
-	classes            []int
-	requestMappings    map[string]*regexp.Regexp
-	regexStaticContent *regexp.Regexp
-	stats              map[string]map[string]*accountingSet
-	zabbixConfig       zabbixConfigSetting
-	failedZabbixSends  int64
-	fractionOfSecond   int
+	classes             []int
+	percentiles         []float64
+	latencyCodeClasses  map[string]bool
+	errorCodeClasses    map[string]bool
+	requestMappings     map[string]*regexp.Regexp
+	requestMappingOrder []string
+	firstMatch          bool
+	// accounting set names created by the templates of request mappings
+	mappingTemplates map[string]string
+	mappingMaxNames  map[string]int
+	maxMappingNames  int
+	mappingNames     map[string]map[string]map[string]bool
+	// accounting sets without requests for this duration are removed, 0 keeps them forever
+	idleTTL time.Duration
+	// the lifetime counters are persisted in this file across restarts
+	stateFile string
+	// limits of the number of vhosts and accounting sets
+	cardinality         cardinalityLimits
+	vhostNormalizer     vhostNormalizer
+	regexStaticContent  *regexp.Regexp
+	staticContentAccset string
+	staticContentDrop   bool
+	stats               map[string]map[string]*accountingSet
+	exporters           []MetricsExporter
+	fractionOfSecond    int
+	// the start of the current sending interval
+	intervalStart time.Time
+	// the clock of the loglines is used for the snapshots instead of the current time
+	useLogClock      bool
+	logClock         time.Time
+	logInterval      time.Time
+	logLastDiscovery time.Time
 }
 
 // CompleteChan is used to wait for accounting completion
 var CompleteChan = make(chan int64)
 
+// syncChan is used to wait for the accounting of the PerfSets sent before a SYNC
+var syncChan = make(chan bool)
+
 // SignalChan is used to wait for signals
 var SignalChan = make(chan os.Signal, 1)
 
 var sendMutex sync.Mutex
 
-// NewRequestAccounting creates a RequestAccounting instance
+// statsMutex guards the statistics against concurrent modification
+var statsMutex sync.Mutex
+
+// NewRequestAccounting creates a RequestAccounting instance which consumes the PerfSetChan
 func NewRequestAccounting(cfg Configuration) *RequestAccounting {
+	RequestAccountingInst := newRequestAccounting(cfg)
+	RequestAccountingInst.loadState()
+	go RequestAccountingInst.consumePerfSets(cfg.DiscoveryInterval, cfg.SendingInterval, cfg.Timeout)
+	return RequestAccountingInst
+}
+
+// newRequestAccounting creates a RequestAccounting instance without consuming the PerfSetChan
+func newRequestAccounting(cfg Configuration) *RequestAccounting {
 	// RequestAccountingInst configures the accounting
 	RequestAccountingInst := RequestAccounting{
 		// a list of accounting classes, defined in microseconds
 		classes: cfg.ResponstimeClasses,
+		// the percentiles of the response times
+		percentiles: cfg.Percentiles,
 		// a map of requesttypes containing compiled regexes
-		requestMappings:    cfg.RequestMappings,
-		regexStaticContent: regexp.MustCompile(cfg.RegexStaticContentString),
+		requestMappings:     cfg.RequestMappings,
+		requestMappingOrder: cfg.RequestMappingOrder,
+		// the first matching request mapping wins instead of accounting all matching mappings
+		firstMatch:       cfg.RequestMappingMode == "first",
+		mappingTemplates: cfg.RequestMappingTemplates,
+		mappingMaxNames:  cfg.RequestMappingMaxNames,
+		maxMappingNames:  cfg.MaxMappingNames,
+		mappingNames:     map[string]map[string]map[string]bool{},
+		// static content is accounted in a separate accounting set or dropped
+		staticContentAccset: cfg.StaticContentAccset,
+		staticContentDrop:   cfg.StaticContentDrop,
 		// the current state of the statistics
 		stats: map[string]map[string]*accountingSet{},
-		zabbixConfig: zabbixConfigSetting{
-			Server:       cfg.ZabbixServer,
-			ServerPort:   10050,
-			Host:         cfg.ZabbixHost,
-			DiscoveryKey: "apache.discovery",
-			BaseKey:      "apache.acc",
-			Disabled:     cfg.ZabbixSendDisabled,
-		},
+		// the statistics are aggregated by the timestamps of the loglines
+		useLogClock: cfg.LogClock,
+		idleTTL:     cfg.IdleTTL,
+		stateFile:   cfg.AccountingStateFile,
+		// the elapsed time of the first sending interval starts now
+		intervalStart: time.Now(),
+	}
+	if cfg.RequestMappingMode != "all" && cfg.RequestMappingMode != "first" {
+		glog.Fatalf("unknown request_mapping_mode '%s', supported are all and first", cfg.RequestMappingMode)
+	}
+	if !isMappingOrder(RequestAccountingInst.requestMappingOrder, RequestAccountingInst.requestMappings) {
+		RequestAccountingInst.requestMappingOrder = sortedMappingNames(RequestAccountingInst.requestMappings)
+	}
+	if cfg.RegexStaticContentString != "" {
+		RequestAccountingInst.regexStaticContent = regexp.MustCompile(cfg.RegexStaticContentString)
+	}
+	var err error
+	RequestAccountingInst.latencyCodeClasses, err = newCodeClassSet(cfg.LatencyCodeClasses)
+	if err != nil {
+		glog.Fatalf("invalid latency_code_classes: %s", err.Error())
+	}
+	RequestAccountingInst.errorCodeClasses, err = newCodeClassSet(cfg.ErrorCodeClasses)
+	if err != nil {
+		glog.Fatalf("invalid error_code_classes: %s", err.Error())
+	}
+	RequestAccountingInst.vhostNormalizer, err = newVhostNormalizer(cfg)
+	if err != nil {
+		glog.Fatalf("invalid vhost normalization: %s", err.Error())
+	}
+	RequestAccountingInst.cardinality, err = newCardinalityLimits(cfg)
+	if err != nil {
+		glog.Fatalf("invalid cardinality limits: %s", err.Error())
+	}
+	for _, name := range cfg.Exporters {
+		exporter, err := NewExporter(name, cfg)
+		if err != nil {
+			glog.Fatalf("unable to create exporter: %s", err.Error())
+		}
+		RequestAccountingInst.AddExporter(exporter)
 	}
-	go RequestAccountingInst.consumePerfSets(cfg.DiscoveryInterval, cfg.SendingInterval, cfg.Timeout)
 	return &RequestAccountingInst
 }
 
+// AddExporter adds a exporter which receives the statistics
+func (c *RequestAccounting) AddExporter(exporter MetricsExporter) {
+	c.exporters = append(c.exporters, exporter)
+}
+
 // GetFailedZabbixSends Returns the number of failed zabbix data deliveries
 func (c *RequestAccounting) GetFailedZabbixSends() int64 {
-	return c.failedZabbixSends
+	var failed int64
+	for _, exporter := range c.exporters {
+		if zabbixExporter, ok := exporter.(*ZabbixExporter); ok {
+			failed += zabbixExporter.GetFailedSends()
+		}
+	}
+	return failed
+}
+
+// GetSkippedZabbixSends Returns the number of zabbix data deliveries which were spooled during the retry backoff
+func (c *RequestAccounting) GetSkippedZabbixSends() int64 {
+	var skipped int64
+	for _, exporter := range c.exporters {
+		if zabbixExporter, ok := exporter.(*ZabbixExporter); ok {
+			skipped += zabbixExporter.GetSkippedSends()
+		}
+	}
+	return skipped
+}
+
+// GetZabbixSpoolStatus Returns the status of the packets which were not delivered to zabbix yet
+func (c *RequestAccounting) GetZabbixSpoolStatus() ZabbixSpoolStatus {
+	var status ZabbixSpoolStatus
+	for _, exporter := range c.exporters {
+		if zabbixExporter, ok := exporter.(*ZabbixExporter); ok {
+			spoolStatus := zabbixExporter.GetSpoolStatus()
+			status.Packets += spoolStatus.Packets
+			status.Dropped += spoolStatus.Dropped
+			if spoolStatus.Age > status.Age {
+				status.Age = spoolStatus.Age
+			}
+		}
+	}
+	return status
+}
+
+// sortedMappingNames is the order of request mappings without a configured order
+func sortedMappingNames(mappings map[string]*regexp.Regexp) []string {
+	names := []string{}
+	for name := range mappings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// isMappingOrder checks if the order contains exactly the names of the request mappings
+func isMappingOrder(order []string, mappings map[string]*regexp.Regexp) bool {
+	if len(order) != len(mappings) {
+		return false
+	}
+	for _, name := range order {
+		if mappings[name] == nil {
+			return false
+		}
+	}
+	return true
 }
 
 // SetRequestMappings defined a new set of request mappings
 func (c *RequestAccounting) SetRequestMappings(mappings map[string]*regexp.Regexp) {
 	c.requestMappings = mappings
+	c.requestMappingOrder = sortedMappingNames(mappings)
 }
 
 // DisableZabbixSender Disables or Enables the submission of zabbix statistics
 func (c *RequestAccounting) DisableZabbixSender(disable bool) {
-	c.zabbixConfig.Disabled = disable
+	for _, exporter := range c.exporters {
+		if zabbixExporter, ok := exporter.(*ZabbixExporter); ok {
+			zabbixExporter.SetDisabled(disable)
+		}
+	}
 }
 
+// getPerfclass returns the highest class which is lower or equal than the responsetime
 func (c *RequestAccounting) getPerfclass(responsetime int) int {
+	found := false
+	result := 0
 	for _, perfclass := range c.classes {
-		if responsetime >= perfclass {
-			return perfclass
+		if responsetime >= perfclass && (!found || perfclass > result) {
+			result = perfclass
+			found = true
 		}
 	}
-	glog.Warningf("No perf class found for responstime %d", responsetime)
-	return 0
+	if !found {
+		glog.Warningf("No perf class found for responstime %d", responsetime)
+	}
+	return result
 }
 
-func (c *RequestAccounting) sendDiscovery() {
-	sendMutex.Lock()
-	defer sendMutex.Unlock()
-	if c.zabbixConfig.Disabled {
-		glog.V(1).Info("Zabbix sender disabled, not sending data")
-		return
+// now returns the time of the statistics, which is the current time or the clock of the loglines
+func (c *RequestAccounting) now() time.Time {
+	if c.useLogClock && !c.logClock.IsZero() {
+		return c.logClock
 	}
-	glog.Info("Sending discovery")
-
-	var discoveryDataArray []map[string]string
+	return time.Now()
+}
 
-	for vhost, vhostData := range c.stats {
-		for accset := range vhostData {
-			discoveryItem := map[string]string{
-				"{#NAME}":   vhost,
-				"{#ACCSET}": accset,
-			}
-			discoveryDataArray = append(discoveryDataArray, discoveryItem)
+// advanceLogClock moves the clock to the timestamp of a request, when the request belongs to a later
+// sending interval the statistics are submitted with the clock of the start of that interval
+func (c *RequestAccounting) advanceLogClock(timestamp string, discoveryInterval time.Duration, sendingInterval time.Duration) {
+	requestTime, err := ParseTimestamp(timestamp)
+	if err != nil {
+		glog.V(1).Infof("unable to use request time for the clock: %s", err.Error())
+		return
+	}
+	interval := requestTime.Truncate(sendingInterval)
+	if c.logInterval.IsZero() {
+		c.logInterval = interval
+		statsMutex.Lock()
+		c.intervalStart = interval
+		statsMutex.Unlock()
+	}
+	if interval.After(c.logInterval) {
+		statsMutex.Lock()
+		c.logClock = interval
+		statsMutex.Unlock()
+		if c.logLastDiscovery.IsZero() || interval.Sub(c.logLastDiscovery) >= discoveryInterval {
+			c.sendDiscovery()
+			c.logLastDiscovery = interval
 		}
+		c.sendData()
+		c.logInterval = interval
 	}
-	jsonString, err := json.Marshal(discoveryDataArray)
-	if err != nil {
-		glog.Fatalf("unable to marshal json discovery data: %s", err.Error())
+	// requests which are older than the current interval are accounted to the current interval
+	statsMutex.Lock()
+	if requestTime.After(c.logClock) {
+		c.logClock = requestTime
 	}
-	glog.Infof("sending discovery data >>>%s<<<", string(jsonString))
-	var metrics []*Metric
-	metrics = append(metrics, NewMetric(c.zabbixConfig.Host, c.zabbixConfig.DiscoveryKey, string(jsonString), time.Now().Unix()))
-	c.sendZabbixMetrics(metrics)
+	statsMutex.Unlock()
 }
 
-func (c *RequestAccounting) sendZabbixMetrics(metrics []*Metric) {
-	if c.zabbixConfig.Disabled {
-		glog.Info("Zabbix sender disabled, not sending data")
-	} else {
-		packet := NewPacket(metrics)
-		z := NewSender(c.zabbixConfig.Server, c.zabbixConfig.ServerPort)
-		res, err := z.Send(packet)
-		if err != nil {
-			glog.Errorf("unable to send discovery key : '%s' - >>>%s<<<", err.Error(), res)
-			c.failedZabbixSends++
+// snapshot creates a consistent copy of the statistics, a data snapshot starts a new sending interval
+func (c *RequestAccounting) snapshot(data bool) *StatsSnapshot {
+	statsMutex.Lock()
+	defer statsMutex.Unlock()
+	snapshot := &StatsSnapshot{
+		Time:    c.now(),
+		Stats:   map[string]map[string]*accountingSet{},
+		Dropped: c.GetDroppedRequests(),
+		Folded:  c.GetFoldedRequests(),
+	}
+	c.expireIdle(snapshot.Time)
+	elapsed := snapshot.Time.Sub(c.intervalStart)
+	if data {
+		c.intervalStart = snapshot.Time
+	}
+	for vhost, vhostData := range c.stats {
+		snapshot.Stats[vhost] = map[string]*accountingSet{}
+		for accset, accsetData := range vhostData {
+			if data {
+				accsetData.finishInterval(c.percentiles, c.classes, elapsed)
+			}
+			snapshot.Stats[vhost][accset] = accsetData.copy()
 		}
 	}
+	return snapshot
 }
 
-func (c *RequestAccounting) createZabbixMetric(dataTime int64, value string, keys ...string) *Metric {
-	key := fmt.Sprintf("%s[%s]", c.zabbixConfig.BaseKey, strings.Join(keys, ","))
-	glog.V(1).Infof("Creating metric : %s = %s", key, value)
-	return NewMetric(c.zabbixConfig.Host, key, string(value), dataTime)
-}
-
-func (c *RequestAccounting) sendData() {
-	sendMutex.Lock()
-	defer sendMutex.Unlock()
-	if c.zabbixConfig.Disabled {
-		glog.V(1).Info("Zabbix sender disabled, not sending data")
+// expireIdle removes the accounting sets which were not seen within the idle ttl, they are no longer discovered
+// and zabbix removes their items after the lifetime of the discovery rule, the counters of a accounting set
+// which receives requests again restart at 0, the caller holds the statsMutex
+func (c *RequestAccounting) expireIdle(now time.Time) {
+	if c.idleTTL <= 0 {
 		return
 	}
-	glog.Info("Sending data")
-	var metrics []*Metric
-
-	dataTime := time.Now().Unix()
-
 	for vhost, vhostData := range c.stats {
 		for accset, accsetData := range vhostData {
-			metrics = append(metrics, c.createZabbixMetric(dataTime, strconv.FormatInt(accsetData.Count, 10), vhost, accset, "count"))
-			metrics = append(metrics, c.createZabbixMetric(dataTime, strconv.FormatInt(accsetData.Sum, 10), vhost, accset, "sum"))
-
-			/*
-			 * Calculate differential statistics
-			 */
-			requestsProcessed := accsetData.Count - accsetData.lastCount
-			timeTaken := accsetData.Sum - accsetData.lastSum
-			var requestsPerSecond string = "0"
-			if requestsProcessed > 0 {
-				requestsPerSecond = fmt.Sprintf("%f", float64(timeTaken/requestsProcessed))
-			}
-			accsetData.lastCount = accsetData.Count
-			accsetData.lastSum = accsetData.Sum
-			metrics = append(metrics, c.createZabbixMetric(dataTime, requestsPerSecond, vhost, accset, "req_s"))
-
-			for class, count := range accsetData.Classes {
-				metrics = append(metrics, c.createZabbixMetric(dataTime, strconv.FormatInt(count, 10), vhost, accset, "class", fmt.Sprintf("%d", class)))
+			if now.Sub(accsetData.LastSeen) < c.idleTTL {
+				continue
 			}
-
-			for code, count := range accsetData.Codes {
-				metrics = append(metrics, c.createZabbixMetric(dataTime, strconv.FormatInt(count, 10), vhost, accset, "code", fmt.Sprintf("%d", code)))
+			glog.V(1).Infof("expiring accounting set %s of vhost %s, last seen %s", accset, vhost, accsetData.LastSeen.Format(time.RFC3339))
+			delete(vhostData, accset)
+			// the name is available again for the templates of the request mappings
+			for _, names := range c.mappingNames[vhost] {
+				delete(names, accset)
 			}
 		}
+		if len(vhostData) == 0 {
+			delete(c.stats, vhost)
+			delete(c.mappingNames, vhost)
+		}
+	}
+}
+
+func (c *RequestAccounting) sendDiscovery() {
+	sendMutex.Lock()
+	defer sendMutex.Unlock()
+	snapshot := c.snapshot(false)
+	for _, exporter := range c.exporters {
+		glog.V(1).Infof("Sending discovery to exporter %s", exporter.Name())
+		exporter.SendDiscovery(snapshot)
+	}
+}
+
+func (c *RequestAccounting) sendData() {
+	sendMutex.Lock()
+	defer sendMutex.Unlock()
+	snapshot := c.snapshot(true)
+	for _, exporter := range c.exporters {
+		glog.V(1).Infof("Sending data to exporter %s", exporter.Name())
+		exporter.SendData(snapshot)
 	}
-	c.sendZabbixMetrics(metrics)
 }
 
 func (c *RequestAccounting) collectCodes() []int {
@@ -227,17 +569,25 @@ func (c *RequestAccounting) collectCodes() []int {
 
 // DumpAccountingData dumps the accounting data
 func (c *RequestAccounting) DumpAccountingData() {
-	sendMutex.Lock()
-	defer sendMutex.Unlock()
+	fmt.Printf("\n")
+	c.WriteAccountingTable(os.Stdout)
+}
 
-	table := tablewriter.NewWriter(os.Stdout)
+// WriteAccountingTable writes the accounting data as table
+func (c *RequestAccounting) WriteAccountingTable(w io.Writer) {
+	statsMutex.Lock()
+	defer statsMutex.Unlock()
+
+	table := tablewriter.NewWriter(w)
 
 	header := []string{"Domain", "PerfClass", "Count", "Average ms"}
 
-	fmt.Printf("\n")
 	for _, perfClass := range c.classes {
 		header = append(header, fmt.Sprintf(" >=\n%d\nmSec", perfClass/1000))
 	}
+	for _, percentile := range c.percentiles {
+		header = append(header, fmt.Sprintf("%s\nmSec", PercentileName(percentile)))
+	}
 	codes := c.collectCodes()
 	for _, code := range codes {
 		header = append(header, fmt.Sprintf("HTTP\n%d", code))
@@ -247,15 +597,28 @@ func (c *RequestAccounting) DumpAccountingData() {
 	table.SetHeader(header)
 	table.SetHeaderAlignment(tablewriter.ALIGN_RIGHT)
 	table.SetAutoFormatHeaders(false)
-	for vhost, vhostData := range c.stats {
-		for accset, accsetData := range vhostData {
-			averageTime := float64(accsetData.Sum) / float64(accsetData.Count)
-			row := []string{vhost, accset, strconv.FormatInt(accsetData.Count, 10), fmt.Sprintf("%.03f", averageTime)}
-			for class := range c.classes {
+	for _, vhost := range sortedVhosts(c.stats) {
+		for _, accset := range sortedAccsets(c.stats[vhost]) {
+			accsetData := c.stats[vhost][accset]
+			row := []string{vhost, accset, strconv.FormatInt(accsetData.Count, 10)}
+			if accsetData.Count > 0 {
+				row = append(row, fmt.Sprintf("%.03f", float64(accsetData.Sum)/float64(accsetData.Count)/1000))
+			} else {
+				row = append(row, "-")
+			}
+			for _, class := range c.classes {
 				row = append(row, strconv.FormatInt(accsetData.Classes[class], 10))
 			}
+			for _, percentile := range c.percentiles {
+				value, ok := accsetData.Percentiles[PercentileName(percentile)]
+				if !ok {
+					row = append(row, "-")
+					continue
+				}
+				row = append(row, fmt.Sprintf("%.03f", float64(value)/1000))
+			}
 
-			for code := range codes {
+			for _, code := range codes {
 				row = append(row, strconv.FormatInt(accsetData.Codes[code], 10))
 			}
 			table.Append(row)
@@ -274,11 +637,23 @@ func CompleteStream() {
 	}
 }
 
+// SyncStream waits until the PerfSets which were sent before are accounted
+func SyncStream() {
+	PerfSetChan <- PerfSet{
+		Domain: "SYNC",
+		Ident:  "SYNC",
+		Time:   "0",
+		Code:   1,
+	}
+	<-syncChan
+}
+
 // ConsumePerfSets from channel PerfSetChan and send discoveries and data
 func (c *RequestAccounting) consumePerfSets(discoveryIntervalSeconds int, sendingIntervalSeconds int, timeoutSeconds int) {
 	var count int64 = 0
 	var timeLastDiscovery time.Time = time.Now()
 	var timeLastStats time.Time = time.Now()
+	var timeLastState time.Time = time.Now()
 
 	for {
 		select {
@@ -287,6 +662,9 @@ func (c *RequestAccounting) consumePerfSets(discoveryIntervalSeconds int, sendin
 				glog.Infof("got %s signal, terminating myself now", signal)
 				c.sendDiscovery()
 				c.sendData()
+				c.saveState()
+				// the buffered loglines are written and the compression of the logfiles is completed
+				TerminateLogSink()
 				os.Exit(1)
 			}
 		case perfSet := <-PerfSetChan:
@@ -294,20 +672,40 @@ func (c *RequestAccounting) consumePerfSets(discoveryIntervalSeconds int, sendin
 				if perfSet.Domain == "COMPLETE" {
 					glog.Info("Processing complete")
 					c.SubmitData()
+					c.saveState()
 					CompleteChan <- count
 					return
 				}
+				if perfSet.Domain == "SYNC" {
+					syncChan <- true
+					continue
+				}
 				glog.V(2).Infof("Consume a PerfSet domain: %s, ident: %s, time %s, code %d", perfSet.Domain, perfSet.Ident, perfSet.Time, perfSet.Code)
+				if c.useLogClock {
+					c.advanceLogClock(perfSet.Timestamp, time.Duration(discoveryIntervalSeconds)*time.Second, time.Duration(sendingIntervalSeconds)*time.Second)
+				}
 				if c.AccountRequest(perfSet.Domain, perfSet.Ident, perfSet.Time, perfSet.Code) {
 					count++
 				}
 			}
 		case <-time.After(time.Duration(timeoutSeconds) * time.Second):
 			{
+				// with the log clock the current interval is incomplete until a later request or the end of the stream
 				glog.V(2).Infof("Timeout after %d seconds", timeoutSeconds)
 			}
 		}
 
+		// the state is written periodically to limit the loss of counters by a crash
+		if time.Since(timeLastState) > time.Duration(sendingIntervalSeconds)*time.Second {
+			c.saveState()
+			timeLastState = time.Now()
+		}
+
+		if c.useLogClock {
+			// the statistics are submitted by advanceLogClock
+			continue
+		}
+
 		elapsedSecondsDataDiscovery := int(time.Since(timeLastDiscovery) / 1000000000)
 		if elapsedSecondsDataDiscovery > discoveryIntervalSeconds {
 			c.sendDiscovery()
@@ -329,26 +727,106 @@ func (c *RequestAccounting) SubmitData() {
 	c.sendData()
 }
 
+// newAccountingSet creates a empty accounting set with all configured classes
+func (c *RequestAccounting) newAccountingSet() *accountingSet {
+	accsetData := &accountingSet{
+		Count:       0,
+		Sum:         0,
+		Codes:       make(map[int]int64),
+		Classes:     make(map[int]int64),
+		CodeClasses: make(map[string]int64),
+		Percentiles: make(map[string]int64),
+		latencies:   newLatencyHistogram(),
+		Interval:    newIntervalSet(c.classes),
+		current:     newIntervalSet(c.classes),
+	}
+	for _, perfclass := range c.classes {
+		accsetData.Classes[perfclass] = 0
+	}
+	return accsetData
+}
+
+// addAccounting accounts the request in a accounting set, it returns true if the request was folded
+// into the overflow vhost or the other accounting set by the cardinality limits
 func (c *RequestAccounting) addAccounting(domain string, ident string, responsetime int, code int) bool {
+	statsMutex.Lock()
+	limitedDomain := c.cardinality.limitVhost(c.stats, domain)
+	limitedIdent := c.cardinality.limitAccset(c.stats, limitedDomain, ident)
+	folded := limitedDomain != domain || limitedIdent != ident
+	domain, ident = limitedDomain, limitedIdent
 	if c.stats[domain] == nil {
 		c.stats[domain] = make(map[string]*accountingSet)
 	}
 	if c.stats[domain][ident] == nil {
-		c.stats[domain][ident] = &accountingSet{
-			Count:   0,
-			Sum:     0,
-			Codes:   make(map[int]int64),
-			Classes: make(map[int]int64),
-		}
-		for _, perfclass := range c.classes {
-			c.stats[domain][ident].Classes[perfclass] = 0
+		c.stats[domain][ident] = c.newAccountingSet()
+	}
+	accsetData := c.stats[domain][ident]
+	accsetData.LastSeen = c.now()
+	codeClass := CodeClass(code)
+	isError := c.errorCodeClasses[codeClass]
+	accsetData.Requests++
+	accsetData.Codes[code]++
+	accsetData.CodeClasses[codeClass]++
+	if isError {
+		accsetData.Errors++
+	}
+	accsetData.current.addRequest(code, isError)
+
+	timed := c.latencyCodeClasses[codeClass]
+	if timed {
+		accsetData.Sum += int64(responsetime)
+		accsetData.Count++
+		perfclass := c.getPerfclass(responsetime)
+		accsetData.Classes[perfclass]++
+		accsetData.latencies.add(int64(responsetime))
+		accsetData.current.addLatency(int64(responsetime), perfclass)
+	}
+	statsMutex.Unlock()
+
+	for _, exporter := range c.exporters {
+		if observer, ok := exporter.(RequestObserver); ok {
+			observer.ObserveRequest(domain, ident, responsetime, code, timed)
 		}
 	}
-	c.stats[domain][ident].Sum += int64(responsetime)
-	c.stats[domain][ident].Count++
-	c.stats[domain][ident].Codes[code]++
-	c.stats[domain][ident].Classes[c.getPerfclass(responsetime)]++
-	return true
+	return folded
+}
+
+// OtherAccset is the accounting set of requests which exceed the limit of names created by a request mapping template
+const OtherAccset = "other"
+
+// mappingAccset returns the accounting set of a matching request mapping, a template like "api_$1" creates
+// the name from the capture groups of the regex until the limit of names per vhost and mapping is reached,
+// it returns true if the name was folded into the other accounting set
+func (c *RequestAccounting) mappingAccset(domain string, name string, uri string, match []int) (string, bool) {
+	template, ok := c.mappingTemplates[name]
+	if !ok {
+		return name, false
+	}
+	accset := string(c.requestMappings[name].ExpandString(nil, template, uri, match))
+	if accset == "" {
+		return name, false
+	}
+	if c.mappingNames[domain] == nil {
+		c.mappingNames[domain] = map[string]map[string]bool{}
+	}
+	names := c.mappingNames[domain][name]
+	if names == nil {
+		names = map[string]bool{}
+		c.mappingNames[domain][name] = names
+	}
+	if names[accset] {
+		return accset, false
+	}
+	maxNames, ok := c.mappingMaxNames[name]
+	if !ok {
+		maxNames = c.maxMappingNames
+	}
+	if maxNames > 0 && len(names) >= maxNames {
+		glog.V(1).Infof("limit of %d names of request mapping %s reached for %s, accounting %s as %s", maxNames, name, domain, accset, OtherAccset)
+		return OtherAccset, true
+	}
+	names[accset] = true
+	return accset, false
 }
 
 // AccountRequest accounts the request :-)
@@ -358,17 +836,50 @@ func (c *RequestAccounting) AccountRequest(domain string, uri string, time strin
 		glog.Infof("unable to convert time '%s' to a string", time)
 		return false
 	}
-	matchStatic := c.regexStaticContent.FindStringSubmatch(uri)
-	if len(matchStatic) != 0 {
-		c.addAccounting(domain, "NOT MATCHED", responsetime, code)
+	normalized := c.vhostNormalizer.normalize(domain)
+	domain, ok := c.cardinality.filterVhost(normalized)
+	if !ok {
+		return false
+	}
+	// limit the vhosts before creating accounting set names for the vhost
+	statsMutex.Lock()
+	domain = c.cardinality.limitVhost(c.stats, domain)
+	statsMutex.Unlock()
+	// a request is counted once as folded, even if it is accounted in several accounting sets
+	folded := domain != normalized
+	if c.regexStaticContent != nil && c.regexStaticContent.MatchString(uri) {
+		if c.staticContentDrop {
+			glog.V(2).Infof("dropping static content request %s", uri)
+			return false
+		}
+		if c.addAccounting(domain, c.staticContentAccset, responsetime, code) || folded {
+			c.cardinality.countFolded()
+		}
 		return true
 	}
-	for name, reName := range c.requestMappings {
-		match := reName.FindStringSubmatch(uri)
-		if len(match) == 0 {
+	matched := false
+	for _, name := range c.requestMappingOrder {
+		match := c.requestMappings[name].FindStringSubmatchIndex(uri)
+		if match == nil {
 			continue
 		}
-		c.addAccounting(domain, name, responsetime, code)
+		// the names of the request mapping templates are removed by the expiry of idle accounting sets
+		statsMutex.Lock()
+		accset, foldedName := c.mappingAccset(domain, name, uri, match)
+		statsMutex.Unlock()
+		if c.addAccounting(domain, accset, responsetime, code) || foldedName {
+			folded = true
+		}
+		matched = true
+		if c.firstMatch {
+			break
+		}
+	}
+	if !matched && c.addAccounting(domain, UnmatchedAccset, responsetime, code) {
+		folded = true
+	}
+	if folded {
+		c.cardinality.countFolded()
 	}
 	return true
 }
@@ -380,6 +891,8 @@ func (c *RequestAccounting) ShowStats() {
 
 // ShowStats displays the statistics
 func (c *RequestAccounting) GetJsonStats() string {
+	statsMutex.Lock()
+	defer statsMutex.Unlock()
 
 	jsonString, err := json.MarshalIndent(c.stats, "", " ")
 	if err != nil {
@@ -390,6 +903,8 @@ func (c *RequestAccounting) GetJsonStats() string {
 
 // GetStatistics for Testcasess
 func (c *RequestAccounting) GetStatistics() (int64, int64) {
+	statsMutex.Lock()
+	defer statsMutex.Unlock()
 	var vhosts int64 = 0
 	var accountedClasses int64 = 0
 	for _, vhostData := range c.stats {
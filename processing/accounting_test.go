@@ -2,7 +2,10 @@ package processing_test
 
 import (
 	"256bit.org/apache_logpipe/processing"
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"regexp"
 	"testing"
 	"time"
 
@@ -84,6 +87,25 @@ func TestSimpleRequestAccountingWithZabbix(t *testing.T) {
 	assert.Equal(int64(4), requestAccounting.GetFailedZabbixSends())
 }
 
+func TestPerfClasses(t *testing.T) {
+	assert := assert.New(t)
+	requestAccounting := processing.NewRequestAccounting(*processing.NewConfiguration())
+	requestAccounting.DisableZabbixSender(true)
+
+	// the default classes are not sorted, a request belongs to the highest class below its response time
+	for _, responsetime := range []string{"100", "700000", "7000000", "20000000"} {
+		processing.PerfSetChan <- processing.PerfSet{Domain: "dom1", Ident: "/foo", Time: responsetime, Code: 200}
+	}
+	processing.CompleteStream()
+	<-processing.CompleteChan
+
+	var stats map[string]map[string]struct{ Classes map[int]int64 }
+	assert.NoError(json.Unmarshal([]byte(requestAccounting.GetJsonStats()), &stats))
+	for _, accsetData := range stats["dom1"] {
+		assert.Equal(map[int]int64{0: 1, 500000: 1, 5000000: 1, 10000000: 1, 60000000: 0, 300000000: 0}, accsetData.Classes)
+	}
+}
+
 func TestBrokenData(t *testing.T) {
 	assert := assert.New(t)
 
@@ -111,3 +133,339 @@ func TestBrokenData(t *testing.T) {
 	requestAccounting.ShowStats()
 	requestAccounting.SubmitData()
 }
+
+func TestLogClock(t *testing.T) {
+	assert := assert.New(t)
+	cfg := processing.NewConfiguration()
+	cfg.Exporters = []string{}
+	cfg.LogClock = true
+	cfg.SendingInterval = 60
+	cfg.DiscoveryInterval = 300
+	requestAccounting := processing.NewRequestAccounting(*cfg)
+	exporter := &recordingExporter{name: "recorder"}
+	requestAccounting.AddExporter(exporter)
+
+	for _, timestamp := range []string{
+		"07/Apr/2020:05:17:15 +0200",
+		"07/Apr/2020:05:17:59 +0200",
+		"07/Apr/2020:05:18:01 +0200",
+		"07/Apr/2020:05:17:58 +0200",
+		"07/Apr/2020:05:25:30 +0200",
+	} {
+		processing.PerfSetChan <- processing.PerfSet{Domain: "dom1", Ident: "/foo", Time: "100", Code: 200, Timestamp: timestamp}
+	}
+	processing.CompleteStream()
+	<-processing.CompleteChan
+
+	var clocks []string
+	var counts []int64
+	for _, snapshot := range exporter.data {
+		clocks = append(clocks, snapshot.Time.Format("15:04:05"))
+		counts = append(counts, snapshot.Stats["dom1"]["all"].Count)
+	}
+	assert.Equal([]string{"05:18:00", "05:25:00", "05:25:30"}, clocks, "data is stamped with the clock of the loglines")
+	assert.Equal([]int64{2, 4, 5}, counts, "late requests are accounted to the current interval")
+	assert.Len(exporter.discoveries, 3)
+	assert.Equal("05:18:00", exporter.discoveries[0].Time.Format("15:04:05"))
+}
+
+func TestLogClockIdle(t *testing.T) {
+	assert := assert.New(t)
+	cfg := processing.NewConfiguration()
+	cfg.Exporters = []string{}
+	cfg.LogClock = true
+	cfg.SendingInterval = 60
+	cfg.Timeout = 1
+	requestAccounting := processing.NewRequestAccounting(*cfg)
+	exporter := &recordingExporter{name: "recorder"}
+	requestAccounting.AddExporter(exporter)
+
+	processing.PerfSetChan <- processing.PerfSet{Domain: "dom1", Ident: "/foo", Time: "100", Code: 200, Timestamp: "07/Apr/2020:05:17:15 +0200"}
+	time.Sleep(1500 * time.Millisecond)
+	processing.CompleteStream()
+	<-processing.CompleteChan
+
+	assert.Len(exporter.data, 1, "the interval is submitted once at the end of the stream")
+	assert.Equal(1.0/15, exporter.data[0].Stats["dom1"]["all"].Interval.RequestsPerSecond)
+}
+
+func TestIntervalStatistics(t *testing.T) {
+	assert := assert.New(t)
+	cfg := processing.NewConfiguration()
+	cfg.Exporters = []string{}
+	cfg.ResponstimeClasses = []int{0, 1000}
+	cfg.LatencyCodeClasses = []string{"2xx", "4xx"}
+	requestAccounting := processing.NewRequestAccounting(*cfg)
+	exporter := &recordingExporter{name: "recorder"}
+	requestAccounting.AddExporter(exporter)
+	processing.CompleteStream()
+	<-processing.CompleteChan
+
+	requestAccounting.AccountRequest("dom1", "/foo", "500", 200)
+	requestAccounting.AccountRequest("dom1", "/foo", "1500", 404)
+	requestAccounting.SubmitData()
+	requestAccounting.AccountRequest("dom1", "/foo", "100", 200)
+	requestAccounting.SubmitData()
+	requestAccounting.SubmitData()
+
+	first := exporter.data[1].Stats["dom1"]["all"]
+	assert.Equal(int64(2), first.Interval.Count)
+	assert.Equal(int64(2000), first.Interval.Sum)
+	assert.Equal(1000.0, first.Interval.Average)
+	assert.Equal(int64(1500), first.Interval.Max)
+	assert.Equal(map[int]int64{0: 1, 1000: 1}, first.Interval.Classes)
+	assert.Equal(map[int]int64{200: 1, 404: 1}, first.Interval.Codes)
+
+	second := exporter.data[2].Stats["dom1"]["all"]
+	assert.Equal(int64(3), second.Count, "lifetime counters keep growing")
+	assert.Equal(int64(1), second.Interval.Count)
+	assert.Equal(int64(100), second.Interval.Max)
+	assert.Equal(map[int]int64{0: 1, 1000: 0}, second.Interval.Classes)
+	assert.Equal(map[int]int64{200: 1, 404: 0}, second.Interval.Codes)
+
+	third := exporter.data[3].Stats["dom1"]["all"]
+	assert.Equal(int64(0), third.Interval.Count)
+	assert.Equal(0.0, third.Interval.Average)
+	assert.Equal(int64(0), third.Interval.Max)
+	assert.Contains(requestAccounting.GetJsonStats(), `"Interval": {`)
+}
+
+func TestRequestRateAndAverage(t *testing.T) {
+	assert := assert.New(t)
+	cfg := processing.NewConfiguration()
+	cfg.Exporters = []string{}
+	cfg.LogClock = true
+	cfg.SendingInterval = 60
+	requestAccounting := processing.NewRequestAccounting(*cfg)
+	exporter := &recordingExporter{name: "recorder"}
+	requestAccounting.AddExporter(exporter)
+
+	for _, perfSet := range []processing.PerfSet{
+		{Domain: "dom1", Ident: "/foo", Time: "100", Code: 200, Timestamp: "07/Apr/2020:05:17:10 +0200"},
+		{Domain: "dom1", Ident: "/foo", Time: "201", Code: 200, Timestamp: "07/Apr/2020:05:17:50 +0200"},
+		{Domain: "dom1", Ident: "/foo", Time: "700", Code: 200, Timestamp: "07/Apr/2020:05:18:05 +0200"},
+		{Domain: "dom1", Ident: "/foo", Time: "900", Code: 200, Timestamp: "07/Apr/2020:05:20:10 +0200"},
+	} {
+		processing.PerfSetChan <- perfSet
+	}
+	processing.CompleteStream()
+	<-processing.CompleteChan
+
+	assert.Len(exporter.data, 3)
+	first := exporter.data[0].Stats["dom1"]["all"].Interval
+	assert.Equal(150.5, first.Average, "average response time is not truncated")
+	assert.Equal(2.0/60, first.RequestsPerSecond, "2 requests in 60 seconds")
+
+	second := exporter.data[1].Stats["dom1"]["all"].Interval
+	assert.Equal(700.0, second.Average)
+	assert.Equal(1.0/120, second.RequestsPerSecond, "1 request in 120 seconds, the interval without requests is included")
+
+	third := exporter.data[2].Stats["dom1"]["all"].Interval
+	assert.Equal(900.0, third.Average)
+	assert.Equal(1.0/10, third.RequestsPerSecond, "1 request in 10 seconds until the last request")
+}
+
+func TestErrorCodes(t *testing.T) {
+	assert := assert.New(t)
+	cfg := processing.NewConfiguration()
+	cfg.Exporters = []string{}
+	requestAccounting := processing.NewRequestAccounting(*cfg)
+	exporter := &recordingExporter{name: "recorder"}
+	requestAccounting.AddExporter(exporter)
+	processing.CompleteStream()
+	<-processing.CompleteChan
+
+	requestAccounting.AccountRequest("dom1", "/foo", "100", 200)
+	requestAccounting.AccountRequest("dom1", "/foo", "300", 302)
+	requestAccounting.AccountRequest("dom1", "/foo", "5", 404)
+	requestAccounting.AccountRequest("dom1", "/foo", "30000000", 502)
+	requestAccounting.AccountRequest("dom1", "/foo", "1", 101)
+	requestAccounting.SubmitData()
+
+	accsetData := exporter.data[1].Stats["dom1"]["all"]
+	assert.Equal(int64(5), accsetData.Requests)
+	assert.Equal(int64(2), accsetData.Count, "only 2xx and 3xx are included in the latency statistics")
+	assert.Equal(int64(400), accsetData.Sum)
+	assert.Equal(int64(1), accsetData.Errors)
+	assert.Equal(map[string]int64{"1xx": 1, "2xx": 1, "3xx": 1, "4xx": 1, "5xx": 1}, accsetData.CodeClasses)
+	assert.Equal(map[int]int64{101: 1, 200: 1, 302: 1, 404: 1, 502: 1}, accsetData.Codes)
+	assert.Equal(0.2, accsetData.Interval.ErrorRatio)
+	assert.Equal(int64(300), accsetData.Interval.Max)
+
+	cfg.LatencyCodeClasses = []string{"2xx", "5xx"}
+	cfg.ErrorCodeClasses = []string{"4xx", "5xx"}
+	requestAccounting = processing.NewRequestAccounting(*cfg)
+	exporter = &recordingExporter{name: "recorder"}
+	requestAccounting.AddExporter(exporter)
+	processing.CompleteStream()
+	<-processing.CompleteChan
+
+	requestAccounting.AccountRequest("dom1", "/foo", "100", 200)
+	requestAccounting.AccountRequest("dom1", "/foo", "5", 404)
+	requestAccounting.AccountRequest("dom1", "/foo", "30000000", 502)
+	requestAccounting.AccountRequest("dom1", "/foo", "300", 302)
+	requestAccounting.SubmitData()
+
+	accsetData = exporter.data[1].Stats["dom1"]["all"]
+	assert.Equal(int64(2), accsetData.Count)
+	assert.Equal(int64(30000000), accsetData.Interval.Max)
+	assert.Equal(0.5, accsetData.Interval.ErrorRatio)
+}
+
+func TestStaticContentAndUnmatched(t *testing.T) {
+	assert := assert.New(t)
+	cfg := processing.NewConfiguration()
+	cfg.Exporters = []string{}
+	cfg.RequestMappings = map[string]*regexp.Regexp{"api": regexp.MustCompile(`^/api/`)}
+	requestAccounting := processing.NewRequestAccounting(*cfg)
+	processing.CompleteStream()
+	<-processing.CompleteChan
+
+	assert.True(requestAccounting.AccountRequest("dom1", "/api/foo", "100", 200))
+	assert.True(requestAccounting.AccountRequest("dom1", "/logo.PNG", "100", 200))
+	assert.True(requestAccounting.AccountRequest("dom1", "/other", "100", 200))
+	stats := requestAccounting.GetJsonStats()
+	for _, accset := range []string{`"api"`, `"static"`, `"unmatched"`} {
+		assert.Contains(stats, accset)
+	}
+
+	cfg.StaticContentAccset = "assets"
+	cfg.StaticContentDrop = true
+	requestAccounting = processing.NewRequestAccounting(*cfg)
+	processing.CompleteStream()
+	<-processing.CompleteChan
+
+	assert.False(requestAccounting.AccountRequest("dom1", "/logo.png", "100", 200), "static content is dropped")
+	vhosts, accsets := requestAccounting.GetStatistics()
+	assert.Equal(int64(0), vhosts)
+	assert.Equal(int64(0), accsets)
+}
+
+func TestFirstMatchMapping(t *testing.T) {
+	assert := assert.New(t)
+	cfg := processing.NewConfiguration()
+	cfg.Exporters = []string{}
+	cfg.RequestMappings = map[string]*regexp.Regexp{
+		"api":   regexp.MustCompile(`^/api/`),
+		"pages": regexp.MustCompile(`^/`),
+	}
+	cfg.RequestMappingOrder = []string{"api", "pages"}
+
+	for mode, expected := range map[string]map[string]int64{
+		"all":   {"api": 2, "pages": 3},
+		"first": {"api": 2, "pages": 1},
+	} {
+		cfg.RequestMappingMode = mode
+		requestAccounting := processing.NewRequestAccounting(*cfg)
+		exporter := &recordingExporter{name: "recorder"}
+		requestAccounting.AddExporter(exporter)
+		processing.CompleteStream()
+		<-processing.CompleteChan
+
+		requestAccounting.AccountRequest("dom1", "/api/foo", "100", 200)
+		requestAccounting.AccountRequest("dom1", "/api/bar", "100", 200)
+		requestAccounting.AccountRequest("dom1", "/index.html", "100", 200)
+		requestAccounting.SubmitData()
+
+		stats := exporter.data[1].Stats["dom1"]
+		for accset, count := range expected {
+			assert.Equal(count, stats[accset].Count, mode+" "+accset)
+		}
+	}
+}
+
+func TestMappingTemplates(t *testing.T) {
+	assert := assert.New(t)
+	cfg := processing.NewConfiguration()
+	cfg.Exporters = []string{}
+	cfg.RequestMappings = map[string]*regexp.Regexp{
+		"api":   regexp.MustCompile(`^/api/v1/(?P<resource>[a-z]+)`),
+		"pages": regexp.MustCompile(`^/`),
+	}
+	cfg.RequestMappingOrder = []string{"api", "pages"}
+	cfg.RequestMappingMode = "first"
+	cfg.RequestMappingTemplates = map[string]string{"api": "api_${resource}"}
+	cfg.RequestMappingMaxNames = map[string]int{"api": 2}
+	requestAccounting := processing.NewRequestAccounting(*cfg)
+	exporter := &recordingExporter{name: "recorder"}
+	requestAccounting.AddExporter(exporter)
+	processing.CompleteStream()
+	<-processing.CompleteChan
+
+	for _, uri := range []string{"/api/v1/users/1", "/api/v1/users/2", "/api/v1/orders", "/api/v1/items", "/api/v1/carts", "/index.html"} {
+		requestAccounting.AccountRequest("dom1", uri, "100", 200)
+	}
+	requestAccounting.AccountRequest("dom2", "/api/v1/items", "100", 200)
+	requestAccounting.SubmitData()
+
+	stats := exporter.data[1].Stats
+	assert.Equal(int64(2), stats["dom1"]["api_users"].Count)
+	assert.Equal(int64(1), stats["dom1"]["api_orders"].Count)
+	assert.Equal(int64(2), stats["dom1"][processing.OtherAccset].Count, "names exceeding the limit are folded")
+	assert.Equal(int64(1), stats["dom1"]["pages"].Count)
+	assert.Len(stats["dom1"], 4)
+	assert.Equal(int64(1), stats["dom2"]["api_items"].Count, "the limit applies per vhost")
+}
+
+func TestIdleExpiry(t *testing.T) {
+	assert := assert.New(t)
+	cfg := processing.NewConfiguration()
+	cfg.Exporters = []string{}
+	cfg.IdleTTL = 200 * time.Millisecond
+	cfg.RequestMappings = map[string]*regexp.Regexp{"path": regexp.MustCompile(`^/(\w+)`)}
+	cfg.RequestMappingTemplates = map[string]string{"path": "$1"}
+	cfg.MaxMappingNames = 1
+	requestAccounting := processing.NewRequestAccounting(*cfg)
+	exporter := &recordingExporter{name: "recorder"}
+	requestAccounting.AddExporter(exporter)
+	processing.CompleteStream()
+	<-processing.CompleteChan
+
+	requestAccounting.AccountRequest("dom1", "/foo", "100", 200)
+	requestAccounting.AccountRequest("dom2", "/foo", "100", 200)
+	time.Sleep(300 * time.Millisecond)
+	requestAccounting.AccountRequest("dom2", "/bar", "100", 200)
+	requestAccounting.SubmitData()
+
+	stats := exporter.data[1].Stats
+	assert.Nil(stats["dom1"], "idle vhosts expire")
+	assert.Len(stats["dom2"], 1, "idle accounting sets expire")
+	assert.Equal(int64(1), stats["dom2"][processing.OtherAccset].Requests)
+	assert.WithinDuration(time.Now(), stats["dom2"][processing.OtherAccset].LastSeen, time.Second)
+
+	// the expired name is available again for the request mapping template
+	requestAccounting.AccountRequest("dom1", "/bar", "100", 200)
+	requestAccounting.SubmitData()
+	assert.Equal(int64(1), exporter.data[2].Stats["dom1"]["bar"].Requests)
+	assert.Contains(requestAccounting.GetJsonStats(), `"LastSeen"`)
+}
+
+func TestSyncStream(t *testing.T) {
+	assert := assert.New(t)
+	cfg := processing.NewConfiguration()
+	cfg.Exporters = []string{}
+	requestAccounting := processing.NewRequestAccounting(*cfg)
+
+	processing.PerfSetChan <- processing.PerfSet{Domain: "dom1", Ident: "/foo", Time: "100", Code: 200}
+	processing.SyncStream()
+	vhosts, _ := requestAccounting.GetStatistics()
+	assert.Equal(int64(1), vhosts, "the PerfSets before the sync are accounted")
+
+	processing.CompleteStream()
+	assert.Equal(int64(1), <-processing.CompleteChan)
+}
+
+func TestAccountingTableWithoutLatency(t *testing.T) {
+	assert := assert.New(t)
+	cfg := processing.NewConfiguration()
+	cfg.Exporters = []string{}
+	requestAccounting := processing.NewRequestAccounting(*cfg)
+	processing.CompleteStream()
+	<-processing.CompleteChan
+
+	requestAccounting.AccountRequest("dom1", "/foo", "100", 404)
+	var buffer bytes.Buffer
+	requestAccounting.WriteAccountingTable(&buffer)
+	assert.NotContains(buffer.String(), "NaN")
+	assert.Regexp(`dom1 +\| +all +\| +0 +\| +- +\|`, buffer.String(), "the average of no latency requests is not available")
+}
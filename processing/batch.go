@@ -0,0 +1,254 @@
+package processing
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/klauspost/compress/zstd"
+)
+
+// BatchAnalysis accounts historical logfiles in buckets defined by the timestamps of the requests
+type BatchAnalysis struct {
+	cfg             Configuration
+	parser          LogLineParser
+	bucketSize      string
+	buckets         map[int64]*RequestAccounting
+	bucketStart     map[int64]time.Time
+	Lines           int64
+	LinesNotMatched int64
+}
+
+// NewBatchAnalysis creates a BatchAnalysis instance, bucketSize is "hour" or "day"
+func NewBatchAnalysis(cfg Configuration, bucketSize string) (*BatchAnalysis, error) {
+	if bucketSize != "hour" && bucketSize != "day" {
+		return nil, fmt.Errorf("unknown bucket size '%s', supported are hour and day", bucketSize)
+	}
+	parser, err := NewLogLineParser(cfg)
+	if err != nil {
+		return nil, err
+	}
+	// the batch analysis only reports, it does not export
+	cfg.Exporters = []string{}
+	return &BatchAnalysis{
+		cfg:         cfg,
+		parser:      parser,
+		bucketSize:  bucketSize,
+		buckets:     map[int64]*RequestAccounting{},
+		bucketStart: map[int64]time.Time{},
+	}, nil
+}
+
+// truncateTimestamp returns the start of the bucket in the timezone of the timestamp
+func (c *BatchAnalysis) truncateTimestamp(timestamp time.Time) time.Time {
+	if c.bucketSize == "day" {
+		return time.Date(timestamp.Year(), timestamp.Month(), timestamp.Day(), 0, 0, 0, 0, timestamp.Location())
+	}
+	return time.Date(timestamp.Year(), timestamp.Month(), timestamp.Day(), timestamp.Hour(), 0, 0, 0, timestamp.Location())
+}
+
+func (c *BatchAnalysis) getBucket(timestamp time.Time) *RequestAccounting {
+	start := c.truncateTimestamp(timestamp)
+	key := start.Unix()
+	if c.buckets[key] == nil {
+		c.buckets[key] = newRequestAccounting(c.cfg)
+		// the buckets are accounted with the clock of the loglines, i.e. for the time of the last request
+		c.buckets[key].useLogClock = true
+		c.bucketStart[key] = start
+	}
+	return c.buckets[key]
+}
+
+// ProcessLine accounts a single logline
+func (c *BatchAnalysis) ProcessLine(line string) {
+	c.Lines++
+	perfSet, ok := c.parser.Parse(line)
+	if !ok {
+		c.LinesNotMatched++
+		return
+	}
+	timestamp, err := ParseTimestamp(perfSet.Timestamp)
+	if err != nil {
+		glog.V(1).Infof("not matched line, %s: %s", err.Error(), line)
+		c.LinesNotMatched++
+		return
+	}
+	bucket := c.getBucket(timestamp)
+	if timestamp.After(bucket.logClock) {
+		bucket.logClock = timestamp
+	}
+	bucket.AccountRequest(perfSet.Domain, perfSet.Ident, perfSet.Time, perfSet.Code)
+}
+
+// Process accounts all loglines of the reader, gzip or zstd compressed data is decompressed
+func (c *BatchAnalysis) Process(r io.Reader) error {
+	reader, err := decompressingReader(r)
+	if err != nil {
+		return err
+	}
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 65536), 1024*1024)
+	for scanner.Scan() {
+		c.ProcessLine(scanner.Text())
+	}
+	return scanner.Err()
+}
+
+// ProcessFile accounts all loglines of a file
+func (c *BatchAnalysis) ProcessFile(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	glog.Infof("Analyzing logfile %s", filename)
+	return c.Process(f)
+}
+
+var gzipMagic = []byte{0x1f, 0x8b}
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// decompressingReader detects compressed data by the magic bytes
+func decompressingReader(r io.Reader) (io.Reader, error) {
+	buffered := bufio.NewReader(r)
+	magic, _ := buffered.Peek(4)
+	if bytes.HasPrefix(magic, gzipMagic) {
+		return gzip.NewReader(buffered)
+	}
+	if bytes.HasPrefix(magic, zstdMagic) {
+		decoder, err := zstd.NewReader(buffered)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	}
+	return buffered, nil
+}
+
+func (c *BatchAnalysis) sortedBuckets() []int64 {
+	var keys []int64
+	for key := range c.buckets {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys
+}
+
+// WriteReport writes the statistics of all buckets as "table", "csv" or "json"
+func (c *BatchAnalysis) WriteReport(w io.Writer, format string) error {
+	for _, accounting := range c.buckets {
+		for _, vhostData := range accounting.stats {
+			for _, accsetData := range vhostData {
+				accsetData.updatePercentiles(c.cfg.Percentiles, false)
+			}
+		}
+	}
+	switch format {
+	case "table":
+		for _, key := range c.sortedBuckets() {
+			fmt.Fprintf(w, "\n%s\n", c.bucketStart[key].Format(time.RFC3339))
+			c.buckets[key].WriteAccountingTable(w)
+		}
+		return nil
+	case "csv":
+		return c.writeCSVReport(w)
+	case "json":
+		return c.writeJSONReport(w)
+	}
+	return fmt.Errorf("unknown report format '%s', supported are table, csv and json", format)
+}
+
+func (c *BatchAnalysis) writeCSVReport(w io.Writer) error {
+	classes := append([]int{}, c.cfg.ResponstimeClasses...)
+	sort.Ints(classes)
+	codes := map[int]bool{}
+	for _, accounting := range c.buckets {
+		for _, code := range accounting.collectCodes() {
+			codes[code] = true
+		}
+	}
+	var sortedCodes []int
+	for code := range codes {
+		sortedCodes = append(sortedCodes, code)
+	}
+	sort.Ints(sortedCodes)
+
+	writer := csv.NewWriter(w)
+	header := []string{"bucket", "vhost", "accset", "count", "sum", "average_ms"}
+	for _, class := range classes {
+		header = append(header, fmt.Sprintf("class_%d", class))
+	}
+	for _, percentile := range c.cfg.Percentiles {
+		header = append(header, PercentileName(percentile)+"_ms")
+	}
+	for _, code := range sortedCodes {
+		header = append(header, fmt.Sprintf("code_%d", code))
+	}
+	writer.Write(header)
+
+	for _, key := range c.sortedBuckets() {
+		stats := c.buckets[key].stats
+		for _, vhost := range sortedVhosts(stats) {
+			for _, accset := range sortedAccsets(stats[vhost]) {
+				accsetData := stats[vhost][accset]
+				row := []string{
+					c.bucketStart[key].Format(time.RFC3339),
+					vhost,
+					accset,
+					strconv.FormatInt(accsetData.Count, 10),
+					strconv.FormatInt(accsetData.Sum, 10),
+				}
+				// the average and the percentiles are empty if no request of the latency code classes was accounted
+				if accsetData.Count > 0 {
+					row = append(row, fmt.Sprintf("%.03f", float64(accsetData.Sum)/float64(accsetData.Count)/1000))
+				} else {
+					row = append(row, "")
+				}
+				for _, class := range classes {
+					row = append(row, strconv.FormatInt(accsetData.Classes[class], 10))
+				}
+				for _, percentile := range c.cfg.Percentiles {
+					value, ok := accsetData.Percentiles[PercentileName(percentile)]
+					if !ok {
+						row = append(row, "")
+						continue
+					}
+					row = append(row, fmt.Sprintf("%.03f", float64(value)/1000))
+				}
+				for _, code := range sortedCodes {
+					row = append(row, strconv.FormatInt(accsetData.Codes[code], 10))
+				}
+				writer.Write(row)
+			}
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+type batchReportBucket struct {
+	Bucket string                               `json:"bucket"`
+	Stats  map[string]map[string]*accountingSet `json:"stats"`
+}
+
+func (c *BatchAnalysis) writeJSONReport(w io.Writer) error {
+	report := []batchReportBucket{}
+	for _, key := range c.sortedBuckets() {
+		report = append(report, batchReportBucket{
+			Bucket: c.bucketStart[key].Format(time.RFC3339),
+			Stats:  c.buckets[key].stats,
+		})
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", " ")
+	return encoder.Encode(report)
+}
@@ -0,0 +1,115 @@
+package processing_test
+
+import (
+	"256bit.org/apache_logpipe/processing"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func init() {
+	SetupGlogForTests()
+}
+
+var batchTestLines = []string{
+	`127.0.0.1 foo.bar.com:443 - - [07/Apr/2020:05:17:15 +0200] "GET /foo HTTP/1.1" 200 538 "-" "-" 100`,
+	`127.0.0.1 foo.bar.com:443 - - [07/Apr/2020:05:59:59 +0200] "GET /foo HTTP/1.1" 200 538 "-" "-" 300`,
+	`127.0.0.1 foo.bar.com:443 - - [07/Apr/2020:06:00:00 +0200] "GET /foo HTTP/1.1" 301 538 "-" "-" 500`,
+	`127.0.0.1 foo.bar.com:443 - - [08/Apr/2020:01:00:00 +0200] "GET /foo HTTP/1.1" 200 538 "-" "-" 700`,
+	`127.0.0.1 foo.bar.com:443 - - [08/Apr/2020:01:00:00 +0200] "GET /foo HTTP/1.1" 404 538 "-" "-" 700`,
+	`not a logline`,
+}
+
+type batchReportBucket struct {
+	Bucket string
+	Stats  map[string]map[string]struct {
+		Count int64
+		Sum   int64
+	}
+}
+
+func TestBatchAnalysisBuckets(t *testing.T) {
+	assert := assert.New(t)
+	cfg := processing.NewConfiguration()
+
+	for bucketSize, expected := range map[string][]string{
+		"hour": {"2020-04-07T05:00:00+02:00", "2020-04-07T06:00:00+02:00", "2020-04-08T01:00:00+02:00"},
+		"day":  {"2020-04-07T00:00:00+02:00", "2020-04-08T00:00:00+02:00"},
+	} {
+		batch, err := processing.NewBatchAnalysis(*cfg, bucketSize)
+		assert.NoError(err)
+		assert.NoError(batch.Process(strings.NewReader(strings.Join(batchTestLines, "\n"))))
+		assert.Equal(int64(6), batch.Lines)
+		assert.Equal(int64(1), batch.LinesNotMatched)
+
+		var buffer bytes.Buffer
+		assert.NoError(batch.WriteReport(&buffer, "json"))
+		var report []batchReportBucket
+		assert.NoError(json.Unmarshal(buffer.Bytes(), &report))
+		var buckets []string
+		var count, sum int64
+		for _, bucket := range report {
+			buckets = append(buckets, bucket.Bucket)
+			for _, accsets := range bucket.Stats {
+				for _, accset := range accsets {
+					count += accset.Count
+					sum += accset.Sum
+				}
+			}
+		}
+		assert.Equal(expected, buckets, bucketSize)
+		assert.Equal(int64(4), count, bucketSize)
+		assert.Equal(int64(1600), sum, bucketSize)
+	}
+
+	_, err := processing.NewBatchAnalysis(*cfg, "week")
+	assert.Error(err)
+}
+
+func TestBatchAnalysisCompressedCSV(t *testing.T) {
+	assert := assert.New(t)
+	cfg := processing.NewConfiguration()
+
+	var compressed bytes.Buffer
+	w := gzip.NewWriter(&compressed)
+	w.Write([]byte(strings.Join(batchTestLines, "\n")))
+	w.Close()
+
+	batch, err := processing.NewBatchAnalysis(*cfg, "day")
+	assert.NoError(err)
+	assert.NoError(batch.Process(&compressed))
+	assert.Equal(int64(6), batch.Lines)
+
+	var buffer bytes.Buffer
+	assert.NoError(batch.WriteReport(&buffer, "csv"))
+	lines := strings.Split(strings.TrimSpace(buffer.String()), "\n")
+	assert.Len(lines, 3)
+	assert.True(strings.HasPrefix(lines[0], "bucket,vhost,accset,count,sum,average_ms,"), lines[0])
+	assert.True(strings.HasSuffix(lines[0], ",code_200,code_301,code_404"), lines[0])
+	assert.True(strings.HasPrefix(lines[1], "2020-04-07T00:00:00+02:00,foo.bar.com:443,"), lines[1])
+	assert.Contains(lines[1], ",3,900,0.300,")
+	assert.True(strings.HasSuffix(lines[1], ",2,1,0"), lines[1])
+	assert.True(strings.HasSuffix(lines[2], ",1,0,1"), lines[2])
+
+	assert.Error(batch.WriteReport(&buffer, "xml"))
+}
+
+func TestBatchAnalysisCSVWithoutLatency(t *testing.T) {
+	assert := assert.New(t)
+	cfg := processing.NewConfiguration()
+
+	batch, err := processing.NewBatchAnalysis(*cfg, "day")
+	assert.NoError(err)
+	assert.NoError(batch.Process(strings.NewReader(batchTestLines[4])))
+
+	var buffer bytes.Buffer
+	assert.NoError(batch.WriteReport(&buffer, "csv"))
+	lines := strings.Split(strings.TrimSpace(buffer.String()), "\n")
+	assert.Len(lines, 2)
+	assert.NotContains(lines[1], "NaN")
+	assert.Contains(lines[1], ",0,0,,", "the average of no latency requests is empty")
+}
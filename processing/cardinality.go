@@ -0,0 +1,102 @@
+package processing
+
+import (
+	"fmt"
+	"path"
+	"sync/atomic"
+
+	"github.com/golang/glog"
+)
+
+// OverflowVhost is the vhost of requests which exceed the limit of vhosts or are not allowed by the vhost allowlist
+const OverflowVhost = "overflow"
+
+// cardinalityLimits protects the statistics against a unbounded number of vhosts and accounting sets,
+// i.e. created by bogus host headers of scanners
+type cardinalityLimits struct {
+	maxVhosts  int
+	maxAccsets int
+	allowlist  []string
+	denylist   []string
+	// the counters are shared by copies of the RequestAccounting
+	counters *cardinalityCounters
+}
+
+type cardinalityCounters struct {
+	dropped int64
+	folded  int64
+}
+
+func newCardinalityLimits(cfg Configuration) (cardinalityLimits, error) {
+	for _, pattern := range append(append([]string{}, cfg.VhostAllowlist...), cfg.VhostDenylist...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return cardinalityLimits{}, fmt.Errorf("invalid vhost pattern '%s': %s", pattern, err.Error())
+		}
+	}
+	return cardinalityLimits{
+		maxVhosts:  cfg.MaxVhosts,
+		maxAccsets: cfg.MaxAccsetsPerVhost,
+		allowlist:  cfg.VhostAllowlist,
+		denylist:   cfg.VhostDenylist,
+		counters:   &cardinalityCounters{},
+	}, nil
+}
+
+func matchesVhostPattern(patterns []string, vhost string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, vhost); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// filterVhost returns false if requests of the vhost are dropped by the denylist,
+// vhosts which are not in the allowlist are folded into the overflow vhost, the folded requests
+// are counted by the caller once per request
+func (c *cardinalityLimits) filterVhost(vhost string) (string, bool) {
+	if matchesVhostPattern(c.denylist, vhost) {
+		glog.V(2).Infof("dropping request of denied vhost %s", vhost)
+		atomic.AddInt64(&c.counters.dropped, 1)
+		return vhost, false
+	}
+	if len(c.allowlist) > 0 && !matchesVhostPattern(c.allowlist, vhost) {
+		glog.V(2).Infof("vhost %s is not allowed, accounting as %s", vhost, OverflowVhost)
+		return OverflowVhost, true
+	}
+	return vhost, true
+}
+
+// limitVhost folds a new vhost which exceeds the limit into the overflow vhost, the caller holds the statsMutex
+func (c *cardinalityLimits) limitVhost(stats map[string]map[string]*accountingSet, vhost string) string {
+	if stats[vhost] == nil && vhost != OverflowVhost && c.maxVhosts > 0 && len(stats) >= c.maxVhosts {
+		glog.V(1).Infof("limit of %d vhosts reached, accounting %s as %s", c.maxVhosts, vhost, OverflowVhost)
+		return OverflowVhost
+	}
+	return vhost
+}
+
+// limitAccset folds a new accounting set which exceeds the limit into the other accounting set,
+// the caller holds the statsMutex
+func (c *cardinalityLimits) limitAccset(stats map[string]map[string]*accountingSet, vhost string, accset string) string {
+	if stats[vhost][accset] == nil && accset != OtherAccset && c.maxAccsets > 0 && len(stats[vhost]) >= c.maxAccsets {
+		glog.V(1).Infof("limit of %d accounting sets of vhost %s reached, accounting %s as %s", c.maxAccsets, vhost, accset, OtherAccset)
+		return OtherAccset
+	}
+	return accset
+}
+
+// countFolded counts a request which was accounted in the overflow vhost or the other accounting set
+func (c *cardinalityLimits) countFolded() {
+	atomic.AddInt64(&c.counters.folded, 1)
+}
+
+// GetDroppedRequests returns the number of requests dropped by the vhost denylist
+func (c *RequestAccounting) GetDroppedRequests() int64 {
+	return atomic.LoadInt64(&c.cardinality.counters.dropped)
+}
+
+// GetFoldedRequests returns the number of requests which are accounted in the overflow vhost or the other accounting set
+func (c *RequestAccounting) GetFoldedRequests() int64 {
+	return atomic.LoadInt64(&c.cardinality.counters.folded)
+}
@@ -0,0 +1,86 @@
+package processing_test
+
+import (
+	"regexp"
+	"testing"
+
+	"256bit.org/apache_logpipe/processing"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVhostAllowAndDenylist(t *testing.T) {
+	assert := assert.New(t)
+	cfg := processing.NewConfiguration()
+	cfg.Exporters = []string{}
+	cfg.VhostAllowlist = []string{"*.host.edu"}
+	cfg.VhostDenylist = []string{"*.internal.host.edu"}
+	requestAccounting := processing.NewRequestAccounting(*cfg)
+	processing.CompleteStream()
+	<-processing.CompleteChan
+
+	assert.True(requestAccounting.AccountRequest("www.host.edu", "/foo", "100", 200))
+	assert.False(requestAccounting.AccountRequest("db.internal.host.edu", "/foo", "100", 200), "denied vhosts are dropped")
+	assert.True(requestAccounting.AccountRequest("scanner.example.com", "/foo", "100", 200))
+	assert.True(requestAccounting.AccountRequest("1.2.3.4", "/foo", "100", 200))
+
+	stats := requestAccounting.GetJsonStats()
+	assert.Contains(stats, `"www.host.edu"`)
+	assert.Contains(stats, `"`+processing.OverflowVhost+`"`)
+	assert.NotContains(stats, "internal")
+	assert.NotContains(stats, "scanner")
+	assert.Equal(int64(1), requestAccounting.GetDroppedRequests())
+	assert.Equal(int64(2), requestAccounting.GetFoldedRequests())
+}
+
+func TestCardinalityLimits(t *testing.T) {
+	assert := assert.New(t)
+	cfg := processing.NewConfiguration()
+	cfg.Exporters = []string{}
+	cfg.MaxVhosts = 2
+	cfg.MaxAccsetsPerVhost = 2
+	cfg.RequestMappings = map[string]*regexp.Regexp{"path": regexp.MustCompile(`^/(\w+)`)}
+	cfg.RequestMappingTemplates = map[string]string{"path": "$1"}
+	requestAccounting := processing.NewRequestAccounting(*cfg)
+	exporter := &recordingExporter{name: "recorder"}
+	requestAccounting.AddExporter(exporter)
+	processing.CompleteStream()
+	<-processing.CompleteChan
+
+	for _, vhost := range []string{"dom1", "dom2", "dom3", "dom4"} {
+		assert.True(requestAccounting.AccountRequest(vhost, "/foo", "100", 200))
+	}
+	for _, uri := range []string{"/bar", "/baz", "/foo"} {
+		assert.True(requestAccounting.AccountRequest("dom1", uri, "100", 200))
+	}
+	requestAccounting.SubmitData()
+
+	vhosts, _ := requestAccounting.GetStatistics()
+	assert.Equal(int64(3), vhosts, "two vhosts and the overflow vhost")
+	stats := exporter.data[1].Stats
+	assert.Equal(int64(2), stats[processing.OverflowVhost]["foo"].Requests)
+	assert.Equal(int64(2), stats["dom1"]["foo"].Requests)
+	assert.Equal(int64(1), stats["dom1"]["bar"].Requests)
+	assert.Equal(int64(1), stats["dom1"][processing.OtherAccset].Requests)
+	assert.Nil(stats["dom1"]["baz"])
+	assert.Equal(int64(3), requestAccounting.GetFoldedRequests())
+	assert.Equal(int64(3), exporter.data[1].Folded)
+	assert.Equal(int64(0), exporter.data[1].Dropped)
+}
+
+func TestFoldedRequestsCountedOnce(t *testing.T) {
+	assert := assert.New(t)
+	cfg := processing.NewConfiguration()
+	cfg.Exporters = []string{}
+	cfg.MaxVhosts = 1
+	cfg.MaxAccsetsPerVhost = 1
+	cfg.RequestMappings = map[string]*regexp.Regexp{"a": regexp.MustCompile(`^/a`), "b": regexp.MustCompile(`^/ab`)}
+	requestAccounting := processing.NewRequestAccounting(*cfg)
+	processing.CompleteStream()
+	<-processing.CompleteChan
+
+	assert.True(requestAccounting.AccountRequest("dom1", "/x", "100", 200))
+	assert.True(requestAccounting.AccountRequest("dom1", "/ab", "100", 200))
+	assert.Equal(int64(1), requestAccounting.GetFoldedRequests(), "a request of several accounting sets is folded once")
+	assert.True(requestAccounting.AccountRequest("dom2", "/ab", "100", 200))
+	assert.Equal(int64(2), requestAccounting.GetFoldedRequests())
+}
@@ -1,10 +1,13 @@
 package processing
 
 import (
+	"fmt"
 	"os"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/golang/glog"
 	"gopkg.in/ini.v1"
@@ -13,22 +16,73 @@ import (
 type Configuration struct {
 	OutputLogfile            string
 	OutputLogfileSymlink     string
+	Compress                 string
+	CompressInline           bool
+	RetentionMaxAge          time.Duration
+	RetentionMaxFiles        int
+	RetentionMaxTotalBytes   int64
 	SendingInterval          int
 	Timeout                  int
 	DiscoveryInterval        int
 	ZabbixServer             string
 	ZabbixHost               string
 	ZabbixSendDisabled       bool
+	ZabbixSpoolSize          int
+	ZabbixSpoolDir           string
+	ZabbixRetryBackoff       time.Duration
+	Exporters                []string
+	StatsdServer             string
+	StatsdPrefix             string
+	StatsdFlavor             string
+	StatsdMode               string
+	StatsdTags               []string
+	InfluxURL                string
+	InfluxToken              string
+	InfluxFile               string
 	ResponstimeClasses       []int
+	Percentiles              []float64
+	LatencyCodeClasses       []string
+	ErrorCodeClasses         []string
 	RequestMappings          map[string]*regexp.Regexp
+	RequestMappingOrder      []string
+	RequestMappingTemplates  map[string]string
+	RequestMappingMaxNames   map[string]int
+	MaxMappingNames          int
+	MaxVhosts                int
+	MaxAccsetsPerVhost       int
+	VhostAllowlist           []string
+	VhostDenylist            []string
+	VhostStripPort           bool
+	VhostLowercase           bool
+	VhostCollapseWWW         bool
+	VhostAliases             map[string][]string
+	IdleTTL                  time.Duration
+	AccountingStateFile      string
+	RequestMappingMode       string
 	configFile               string
 	RegexLogLineString       string
+	LogFormat                string
+	InputFormat              string
+	FollowFiles              []string
+	FollowStateFile          string
+	TimeUnit                 string
+	LogClock                 bool
+	BatchBucket              string
+	ReportFormat             string
+	JSONDomainPath           string
+	JSONURIPath              string
+	JSONCodePath             string
+	JSONTimePath             string
+	JSONTimestampPath        string
 	RegexStaticContentString string
+	StaticContentAccset      string
+	StaticContentDrop        bool
 	FractionOfSecond         int
 	WebInterfaceListen       string
 	WebInterfaceEnable       bool
 	WebInterfaceUser         string
 	WebInterfacePassword     string
+	WebInterfaceMetricsAuth  bool
 }
 
 // NewConfiguration create a new Configuration object
@@ -37,22 +91,73 @@ func NewConfiguration() *Configuration {
 	cfg.configFile = ""
 	cfg.OutputLogfile = "/dev/null"
 	cfg.OutputLogfileSymlink = ""
+	cfg.Compress = "none"
+	cfg.CompressInline = false
+	cfg.RetentionMaxAge = 0
+	cfg.RetentionMaxFiles = 0
+	cfg.RetentionMaxTotalBytes = 0
 	cfg.SendingInterval = 120
 	cfg.Timeout = 900
 	cfg.ZabbixServer = "zabbix"
 	cfg.ZabbixHost = GetHostname()
 	cfg.ZabbixSendDisabled = false
-	cfg.RegexLogLineString = `^\d+\.\d+\.\d+\.\d+ (?P<domain>[^ ]+?)\s.*] "(GET|POST|PUT|PROPFIND|OPTIONS|DELETE) (?P<uri>/[^ ]*?)(?P<getparam>\?[^ ]*?)? HTTP.*" (?P<code>\d+) .* (?P<time>\d+)$`
+	cfg.ZabbixSpoolSize = 100
+	cfg.ZabbixSpoolDir = ""
+	cfg.ZabbixRetryBackoff = 30 * time.Second
+	cfg.Exporters = []string{"zabbix"}
+	cfg.StatsdServer = "127.0.0.1:8125"
+	cfg.StatsdPrefix = "apache_logpipe"
+	cfg.StatsdFlavor = "statsd"
+	cfg.StatsdMode = "aggregated"
+	cfg.StatsdTags = []string{}
+	cfg.InfluxURL = ""
+	cfg.InfluxToken = ""
+	cfg.InfluxFile = ""
+	cfg.RegexLogLineString = `^\d+\.\d+\.\d+\.\d+ (?P<domain>[^ ]+?)\s.*\[(?P<timestamp>[^\]]+)\] "(GET|POST|PUT|PROPFIND|OPTIONS|DELETE) (?P<uri>/[^ ]*?)(?P<getparam>\?[^ ]*?)? HTTP.*" (?P<code>\d+) .* (?P<time>\d+)$`
+	cfg.LogFormat = ""
+	cfg.InputFormat = "text"
+	cfg.FollowFiles = []string{}
+	cfg.FollowStateFile = ""
+	cfg.TimeUnit = "us"
+	cfg.LogClock = false
+	cfg.BatchBucket = "hour"
+	cfg.ReportFormat = "table"
+	cfg.JSONDomainPath = "vhost"
+	cfg.JSONURIPath = "uri"
+	cfg.JSONCodePath = "status"
+	cfg.JSONTimePath = "time"
+	cfg.JSONTimestampPath = "timestamp"
 	cfg.RegexStaticContentString = `(?i).+\.(gif|jpg|jpeg|png|ico|flv|swf|js|css|txt|woff|ttf)`
+	cfg.StaticContentAccset = "static"
+	cfg.StaticContentDrop = false
 	cfg.ResponstimeClasses = []int{0, 500000, 10000000, 5000000, 60000000, 300000000}
+	cfg.Percentiles = []float64{50, 90, 99}
+	cfg.LatencyCodeClasses = []string{"2xx", "3xx"}
+	cfg.ErrorCodeClasses = []string{"5xx"}
 	cfg.RequestMappings = map[string]*regexp.Regexp{
 		"all": regexp.MustCompile(`([^?]*)\??.*`),
 	}
+	cfg.RequestMappingOrder = []string{"all"}
+	cfg.RequestMappingTemplates = map[string]string{}
+	cfg.RequestMappingMaxNames = map[string]int{}
+	cfg.MaxMappingNames = 100
+	cfg.MaxVhosts = 0
+	cfg.MaxAccsetsPerVhost = 0
+	cfg.VhostAllowlist = []string{}
+	cfg.VhostDenylist = []string{}
+	cfg.VhostStripPort = false
+	cfg.VhostLowercase = false
+	cfg.VhostCollapseWWW = false
+	cfg.VhostAliases = map[string][]string{}
+	cfg.IdleTTL = 0
+	cfg.AccountingStateFile = ""
+	cfg.RequestMappingMode = "all"
 	cfg.FractionOfSecond = 1000000000
 	cfg.WebInterfaceListen = "127.0.0.1:10080"
 	cfg.WebInterfaceUser = "admin"
 	cfg.WebInterfacePassword = "admin"
 	cfg.WebInterfaceEnable = false
+	cfg.WebInterfaceMetricsAuth = true
 	return cfg
 }
 
@@ -81,44 +186,159 @@ func (c *Configuration) LoadFile(configFile string) {
 
 	c.OutputLogfile = getStringValue(iniFile, "global", "output_logile", c.OutputLogfile, defaultCfg.OutputLogfile)
 	c.OutputLogfileSymlink = getStringValue(iniFile, "global", "symlink", c.OutputLogfileSymlink, defaultCfg.OutputLogfileSymlink)
+	c.Compress = getStringValue(iniFile, "global", "compress", c.Compress, defaultCfg.Compress)
+	c.CompressInline = getBoolValue(iniFile, "global", "compress_inline", c.CompressInline, defaultCfg.CompressInline)
+	c.RetentionMaxAge = getDurationValue(iniFile, "global", "max_age", c.RetentionMaxAge, defaultCfg.RetentionMaxAge)
+	c.RetentionMaxFiles = getIntValue(iniFile, "global", "max_files", c.RetentionMaxFiles, defaultCfg.RetentionMaxFiles)
+	c.RetentionMaxTotalBytes = getInt64Value(iniFile, "global", "max_total_bytes", c.RetentionMaxTotalBytes, defaultCfg.RetentionMaxTotalBytes)
 	c.SendingInterval = getIntValue(iniFile, "global", "sending_interval", c.SendingInterval, defaultCfg.SendingInterval)
 	c.Timeout = getIntValue(iniFile, "global", "timeout", c.Timeout, defaultCfg.Timeout)
 	c.DiscoveryInterval = getIntValue(iniFile, "global", "discovery_interval", c.DiscoveryInterval, defaultCfg.DiscoveryInterval)
 	c.ZabbixServer = getStringValue(iniFile, "global", "zabbix_server", c.ZabbixServer, defaultCfg.ZabbixServer)
 	c.ZabbixHost = getStringValue(iniFile, "global", "zabbix_host", c.ZabbixHost, defaultCfg.ZabbixHost)
+	c.ZabbixSpoolSize = getIntValue(iniFile, "global", "zabbix_spool_size", c.ZabbixSpoolSize, defaultCfg.ZabbixSpoolSize)
+	c.ZabbixSpoolDir = getStringValue(iniFile, "global", "zabbix_spool_dir", c.ZabbixSpoolDir, defaultCfg.ZabbixSpoolDir)
+	c.ZabbixRetryBackoff = getDurationValue(iniFile, "global", "zabbix_retry_backoff", c.ZabbixRetryBackoff, defaultCfg.ZabbixRetryBackoff)
+	c.Exporters = getStringListValue(iniFile, "global", "exporters", c.Exporters, defaultCfg.Exporters)
+	c.StatsdServer = getStringValue(iniFile, "statsd", "server", c.StatsdServer, defaultCfg.StatsdServer)
+	c.StatsdPrefix = getStringValue(iniFile, "statsd", "prefix", c.StatsdPrefix, defaultCfg.StatsdPrefix)
+	c.StatsdFlavor = getStringValue(iniFile, "statsd", "flavor", c.StatsdFlavor, defaultCfg.StatsdFlavor)
+	c.StatsdMode = getStringValue(iniFile, "statsd", "mode", c.StatsdMode, defaultCfg.StatsdMode)
+	c.StatsdTags = getStringListValue(iniFile, "statsd", "tags", c.StatsdTags, defaultCfg.StatsdTags)
+	c.InfluxURL = getStringValue(iniFile, "influxdb", "url", c.InfluxURL, defaultCfg.InfluxURL)
+	c.InfluxToken = getStringValue(iniFile, "influxdb", "token", c.InfluxToken, defaultCfg.InfluxToken)
+	c.InfluxFile = getStringValue(iniFile, "influxdb", "file", c.InfluxFile, defaultCfg.InfluxFile)
 	c.FractionOfSecond = getIntValue(iniFile, "global", "fraction_of_second", c.FractionOfSecond, defaultCfg.FractionOfSecond)
 
+	c.WebInterfaceEnable = getBoolValue(iniFile, "global", "webinterface_enable", c.WebInterfaceEnable, defaultCfg.WebInterfaceEnable)
+	c.WebInterfaceListen = getStringValue(iniFile, "global", "webinterface_listen", c.WebInterfaceListen, defaultCfg.WebInterfaceListen)
+	c.WebInterfaceUser = getStringValue(iniFile, "global", "webinterface_user", c.WebInterfaceUser, defaultCfg.WebInterfaceUser)
+	c.WebInterfacePassword = getStringValue(iniFile, "global", "webinterface_password", c.WebInterfacePassword, defaultCfg.WebInterfacePassword)
+	c.WebInterfaceMetricsAuth = getBoolValue(iniFile, "global", "webinterface_metrics_auth", c.WebInterfaceMetricsAuth, defaultCfg.WebInterfaceMetricsAuth)
+
 	c.RegexLogLineString = getStringValue(iniFile, "global", "regex_logline", "", defaultCfg.RegexLogLineString)
+	c.LogFormat = getStringValue(iniFile, "global", "log_format", c.LogFormat, defaultCfg.LogFormat)
+	c.InputFormat = getStringValue(iniFile, "global", "input_format", c.InputFormat, defaultCfg.InputFormat)
+	c.FollowFiles = getStringListValue(iniFile, "global", "follow", c.FollowFiles, defaultCfg.FollowFiles)
+	c.FollowStateFile = getStringValue(iniFile, "global", "follow_state_file", c.FollowStateFile, defaultCfg.FollowStateFile)
+	c.TimeUnit = getStringValue(iniFile, "global", "time_unit", c.TimeUnit, defaultCfg.TimeUnit)
+	c.LogClock = getBoolValue(iniFile, "global", "log_clock", c.LogClock, defaultCfg.LogClock)
+	c.BatchBucket = getStringValue(iniFile, "global", "batch_bucket", c.BatchBucket, defaultCfg.BatchBucket)
+	c.ReportFormat = getStringValue(iniFile, "global", "report_format", c.ReportFormat, defaultCfg.ReportFormat)
+	c.JSONDomainPath = getStringValue(iniFile, "json", "domain", c.JSONDomainPath, defaultCfg.JSONDomainPath)
+	c.JSONURIPath = getStringValue(iniFile, "json", "uri", c.JSONURIPath, defaultCfg.JSONURIPath)
+	c.JSONCodePath = getStringValue(iniFile, "json", "code", c.JSONCodePath, defaultCfg.JSONCodePath)
+	c.JSONTimePath = getStringValue(iniFile, "json", "time", c.JSONTimePath, defaultCfg.JSONTimePath)
+	c.JSONTimestampPath = getStringValue(iniFile, "json", "timestamp", c.JSONTimestampPath, defaultCfg.JSONTimestampPath)
 	c.RegexStaticContentString = getStringValue(iniFile, "global", "regex_static_content", "", defaultCfg.RegexStaticContentString)
+	c.StaticContentAccset = getStringValue(iniFile, "global", "static_content_accset", c.StaticContentAccset, defaultCfg.StaticContentAccset)
+	c.StaticContentDrop = getBoolValue(iniFile, "global", "static_content_drop", c.StaticContentDrop, defaultCfg.StaticContentDrop)
+	// request_mappings is the former name of responsetime_classes and still accepted
 	c.ResponstimeClasses = getResponseTimeClasses(iniFile, "global", "request_mappings", defaultCfg.ResponstimeClasses)
-	c.RequestMappings = getRequestMappings(iniFile, defaultCfg.RequestMappings)
+	c.ResponstimeClasses = getResponseTimeClasses(iniFile, "global", "responsetime_classes", c.ResponstimeClasses)
+	c.Percentiles = getPercentiles(iniFile, "global", "percentiles", c.Percentiles, defaultCfg.Percentiles)
+	c.LatencyCodeClasses = getStringListValue(iniFile, "global", "latency_code_classes", c.LatencyCodeClasses, defaultCfg.LatencyCodeClasses)
+	c.ErrorCodeClasses = getStringListValue(iniFile, "global", "error_code_classes", c.ErrorCodeClasses, defaultCfg.ErrorCodeClasses)
+	c.RequestMappings, c.RequestMappingOrder = getRequestMappings(iniFile, defaultCfg.RequestMappings, defaultCfg.RequestMappingOrder)
+	c.RequestMappingTemplates, c.RequestMappingMaxNames = getRequestMappingNames(iniFile, defaultCfg.RequestMappingTemplates, defaultCfg.RequestMappingMaxNames)
+	c.MaxMappingNames = getIntValue(iniFile, "global", "max_mapping_names", c.MaxMappingNames, defaultCfg.MaxMappingNames)
+	c.MaxVhosts = getIntValue(iniFile, "global", "max_vhosts", c.MaxVhosts, defaultCfg.MaxVhosts)
+	c.MaxAccsetsPerVhost = getIntValue(iniFile, "global", "max_accsets_per_vhost", c.MaxAccsetsPerVhost, defaultCfg.MaxAccsetsPerVhost)
+	c.VhostAllowlist = getStringListValue(iniFile, "global", "vhost_allowlist", c.VhostAllowlist, defaultCfg.VhostAllowlist)
+	c.VhostDenylist = getStringListValue(iniFile, "global", "vhost_denylist", c.VhostDenylist, defaultCfg.VhostDenylist)
+	c.VhostStripPort = getBoolValue(iniFile, "global", "vhost_strip_port", c.VhostStripPort, defaultCfg.VhostStripPort)
+	c.VhostLowercase = getBoolValue(iniFile, "global", "vhost_lowercase", c.VhostLowercase, defaultCfg.VhostLowercase)
+	c.VhostCollapseWWW = getBoolValue(iniFile, "global", "vhost_collapse_www", c.VhostCollapseWWW, defaultCfg.VhostCollapseWWW)
+	c.VhostAliases = getVhostAliases(iniFile, "vhost_aliases", c.VhostAliases)
+	c.IdleTTL = getDurationValue(iniFile, "global", "idle_ttl", c.IdleTTL, defaultCfg.IdleTTL)
+	c.AccountingStateFile = getStringValue(iniFile, "global", "accounting_state_file", c.AccountingStateFile, defaultCfg.AccountingStateFile)
+	c.RequestMappingMode = getStringValue(iniFile, "global", "request_mapping_mode", c.RequestMappingMode, defaultCfg.RequestMappingMode)
+
+}
 
+// reservedSections are ini sections which do not define request mappings
+var reservedSections = map[string]bool{
+	"global":   true,
+	"DEFAULT":  true,
+	"statsd":   true,
+	"influxdb": true,
+	"json":     true,
+	// vhost_aliases maps hostnames onto service names
+	"vhost_aliases": true,
 }
 
-func getRequestMappings(iniFile *ini.File, defaultValue map[string]*regexp.Regexp) map[string]*regexp.Regexp {
+// getRequestMappings returns the request mappings and their order, which is defined by
+// the "priority" key (higher first) and the order of the sections in the file
+func getRequestMappings(iniFile *ini.File, defaultValue map[string]*regexp.Regexp, defaultOrder []string) (map[string]*regexp.Regexp, []string) {
 	if iniFile == nil {
-		return defaultValue
+		return defaultValue, defaultOrder
 	}
 	newRequestMappings := map[string]*regexp.Regexp{}
+	newOrder := []string{}
+	priorities := map[string]int{}
 	for _, section := range iniFile.SectionStrings() {
-		if section == "global" || section == "DEFAULT" {
+		if reservedSections[section] {
 			continue
 		}
 		if iniFile.Section(section).HasKey("regex") {
 			glog.V(1).Infof("parsed request mappings from file: name: >>>%s<<<, regex >>>%s<<<", section, iniFile.Section(section).Key("regex").String())
 			newRequestMappings[section] = regexp.MustCompile(iniFile.Section(section).Key("regex").String())
+			newOrder = append(newOrder, section)
+			priorities[section] = iniFile.Section(section).Key("priority").MustInt(0)
 		}
 	}
 	if len(newRequestMappings) > 0 {
-		return newRequestMappings
+		sort.SliceStable(newOrder, func(i, j int) bool {
+			return priorities[newOrder[i]] > priorities[newOrder[j]]
+		})
+		return newRequestMappings, newOrder
 	}
-	return defaultValue
+	return defaultValue, defaultOrder
+}
+
+// getRequestMappingNames returns the templates of the accounting set names like "api_$1"
+// and the maximum number of names created by the templates of the request mappings
+func getRequestMappingNames(iniFile *ini.File, defaultTemplates map[string]string, defaultMaxNames map[string]int) (map[string]string, map[string]int) {
+	if iniFile == nil {
+		return defaultTemplates, defaultMaxNames
+	}
+	templates := map[string]string{}
+	maxNames := map[string]int{}
+	for _, section := range iniFile.SectionStrings() {
+		if reservedSections[section] || !iniFile.Section(section).HasKey("regex") {
+			continue
+		}
+		if iniFile.Section(section).HasKey("name") {
+			templates[section] = iniFile.Section(section).Key("name").String()
+		}
+		if iniFile.Section(section).HasKey("max_names") {
+			maxNames[section] = iniFile.Section(section).Key("max_names").MustInt(0)
+		}
+	}
+	return templates, maxNames
+}
+
+// getVhostAliases returns the hostnames of the service names defined by the keys of the section,
+// i.e. "shop = shop.example.com, *.shop.example.com"
+func getVhostAliases(iniFile *ini.File, section string, currentValue map[string][]string) map[string][]string {
+	if iniFile == nil || len(currentValue) > 0 {
+		return currentValue
+	}
+	aliases := map[string][]string{}
+	for _, key := range iniFile.Section(section).Keys() {
+		for _, hostname := range key.Strings(",") {
+			if hostname != "" {
+				aliases[key.Name()] = append(aliases[key.Name()], hostname)
+			}
+		}
+	}
+	return aliases
 }
 
 func getResponseTimeClasses(iniFile *ini.File, section string, key string, defaultValue []int) []int {
 	if iniFile != nil && iniFile.Section(section).HasKey(key) {
 		classesByString := strings.Split(iniFile.Section(section).Key(key).String(), ",")
-		classesByInteger := make([]int, 10)
+		classesByInteger := make([]int, 0)
 		for _, classStr := range classesByString {
 			classInt, err := strconv.Atoi(strings.TrimSpace(classStr))
 			if err != nil {
@@ -131,6 +351,29 @@ func getResponseTimeClasses(iniFile *ini.File, section string, key string, defau
 	return defaultValue
 }
 
+func getPercentiles(iniFile *ini.File, section string, key string, currentValue []float64, defaultValue []float64) []float64 {
+	result := currentValue
+	if iniFile != nil && iniFile.Section(section).HasKey(key) && fmt.Sprint(currentValue) == fmt.Sprint(defaultValue) {
+		result = make([]float64, 0)
+		for _, percentileStr := range strings.Split(iniFile.Section(section).Key(key).String(), ",") {
+			if strings.TrimSpace(percentileStr) == "" {
+				continue
+			}
+			percentile, err := strconv.ParseFloat(strings.TrimSpace(percentileStr), 64)
+			if err != nil {
+				glog.Fatalf("unable to convert percentile '%s' to a number", percentileStr)
+			}
+			result = append(result, percentile)
+		}
+	}
+	for _, percentile := range result {
+		if percentile <= 0 || percentile > 100 {
+			glog.Fatalf("percentile %v is not between 0 and 100", percentile)
+		}
+	}
+	return result
+}
+
 func getStringValue(iniFile *ini.File, section string, key string, currentValue string, defaultValue string) string {
 	if iniFile != nil && iniFile.Section(section).HasKey(key) && currentValue == defaultValue {
 		return iniFile.Section(section).Key(key).MustString(defaultValue)
@@ -152,3 +395,50 @@ func getIntValue(iniFile *ini.File, section string, key string, currentValue int
 	return currentValue
 
 }
+
+func getBoolValue(iniFile *ini.File, section string, key string, currentValue bool, defaultValue bool) bool {
+	if iniFile != nil && iniFile.Section(section).HasKey(key) && currentValue == defaultValue {
+		return iniFile.Section(section).Key(key).MustBool(defaultValue)
+	}
+	return currentValue
+
+}
+
+func getInt64Value(iniFile *ini.File, section string, key string, currentValue int64, defaultValue int64) int64 {
+	if iniFile != nil && iniFile.Section(section).HasKey(key) && currentValue == defaultValue {
+		return iniFile.Section(section).Key(key).MustInt64(defaultValue)
+	}
+	if currentValue == 0 {
+		return defaultValue
+	}
+	return currentValue
+
+}
+
+func getDurationValue(iniFile *ini.File, section string, key string, currentValue time.Duration, defaultValue time.Duration) time.Duration {
+	if iniFile != nil && iniFile.Section(section).HasKey(key) && currentValue == defaultValue {
+		return iniFile.Section(section).Key(key).MustDuration(defaultValue)
+	}
+	if currentValue == 0 {
+		return defaultValue
+	}
+	return currentValue
+
+}
+
+func getStringListValue(iniFile *ini.File, section string, key string, currentValue []string, defaultValue []string) []string {
+	if iniFile != nil && iniFile.Section(section).HasKey(key) && strings.Join(currentValue, ",") == strings.Join(defaultValue, ",") {
+		var result []string
+		for _, value := range iniFile.Section(section).Key(key).Strings(",") {
+			if value != "" {
+				result = append(result, value)
+			}
+		}
+		return result
+	}
+	if currentValue == nil {
+		return defaultValue
+	}
+	return currentValue
+
+}
@@ -3,6 +3,7 @@ package processing_test
 import (
 	"256bit.org/apache_logpipe/processing"
 	"flag"
+	"os"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -28,5 +29,84 @@ func TestConfigurationFile(t *testing.T) {
 	assert.Equal(t, "zabbix.host.edu", cfg.ZabbixServer, "Config file has higher precedence than default value")
 	assert.Equal(t, 22, cfg.DiscoveryInterval, "Commandline flag has higher precedence than config file value")
 	assert.IsType(t, cfg.ResponstimeClasses, []int{})
+	assert.Equal(t, []int{0, 500000, 10000000, 5000000, 60000000, 300000000}, cfg.ResponstimeClasses, "only the configured classes")
 	assert.True(t, len(cfg.RequestMappings) == 2)
+	assert.Equal(t, []string{"zabbix"}, cfg.Exporters)
+	assert.Equal(t, []float64{50, 90, 99}, cfg.Percentiles)
+	assert.Equal(t, []string{"2xx", "3xx"}, cfg.LatencyCodeClasses)
+	assert.Equal(t, []string{"without get parameters", "with get parameters"}, cfg.RequestMappingOrder, "order of the sections")
+}
+
+func TestConfigurationMappingPriority(t *testing.T) {
+	testDir := SetupLogfileTestDir()
+	defer RemoveTestDir(testDir)
+	configFile := testDir + "/priority.ini"
+	err := os.WriteFile(configFile, []byte(`[global]
+request_mapping_mode = first
+
+[pages]
+regex = ^/
+
+[api]
+regex = ^/api/(\w+)
+priority = 10
+name = api_$1
+max_names = 20
+
+[images]
+regex = ^/images/
+priority = 10
+
+[health]
+regex = ^/health$
+priority = -1
+`), 0644)
+	assert.NoError(t, err)
+
+	cfg := processing.NewConfiguration()
+	cfg.LoadFile(configFile)
+	assert.Equal(t, "first", cfg.RequestMappingMode)
+	assert.Equal(t, []string{"api", "images", "pages", "health"}, cfg.RequestMappingOrder, "higher priority first, then the order of the sections")
+	assert.Equal(t, map[string]string{"api": "api_$1"}, cfg.RequestMappingTemplates)
+	assert.Equal(t, map[string]int{"api": 20}, cfg.RequestMappingMaxNames)
+}
+
+func TestConfigurationLegacyResponseTimeClasses(t *testing.T) {
+	testDir := SetupLogfileTestDir()
+	defer RemoveTestDir(testDir)
+	configFile := testDir + "/classes.ini"
+	err := os.WriteFile(configFile, []byte(`[global]
+request_mappings = 0, 1000000
+`), 0644)
+	assert.NoError(t, err)
+
+	cfg := processing.NewConfiguration()
+	cfg.LoadFile(configFile)
+	assert.Equal(t, []int{0, 1000000}, cfg.ResponstimeClasses, "the former key of the classes is still accepted")
+}
+
+func TestConfigurationVhostAliases(t *testing.T) {
+	testDir := SetupLogfileTestDir()
+	defer RemoveTestDir(testDir)
+	configFile := testDir + "/aliases.ini"
+	err := os.WriteFile(configFile, []byte(`[global]
+vhost_strip_port = true
+vhost_lowercase = true
+
+[vhost_aliases]
+shop = shop.example.com, *.shop.example.com
+blog = blog.example.com
+`), 0644)
+	assert.NoError(t, err)
+
+	cfg := processing.NewConfiguration()
+	cfg.LoadFile(configFile)
+	assert.True(t, cfg.VhostStripPort)
+	assert.True(t, cfg.VhostLowercase)
+	assert.False(t, cfg.VhostCollapseWWW)
+	assert.Equal(t, map[string][]string{
+		"shop": {"shop.example.com", "*.shop.example.com"},
+		"blog": {"blog.example.com"},
+	}, cfg.VhostAliases)
+	assert.NotContains(t, cfg.RequestMappingOrder, "vhost_aliases")
 }
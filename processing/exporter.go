@@ -0,0 +1,44 @@
+package processing
+
+import (
+	"fmt"
+	"time"
+)
+
+// StatsSnapshot is a consistent copy of the statistics taken at the sending interval
+type StatsSnapshot struct {
+	Time  time.Time
+	Stats map[string]map[string]*accountingSet
+	// Dropped and Folded count the requests affected by the cardinality limits
+	Dropped int64
+	Folded  int64
+}
+
+// MetricsExporter delivers the statistics to a monitoring backend
+type MetricsExporter interface {
+	// Name returns the name of the exporter used in the configuration
+	Name() string
+	// SendDiscovery announces the known vhosts and accounting sets
+	SendDiscovery(snapshot *StatsSnapshot)
+	// SendData delivers the statistics of the current sending interval
+	SendData(snapshot *StatsSnapshot)
+}
+
+// RequestObserver is implemented by exporters which additionally process every single accounted request,
+// timed is false if the response time of the request is not included in the latency statistics
+type RequestObserver interface {
+	ObserveRequest(vhost string, accset string, responsetime int, code int, timed bool)
+}
+
+// NewExporter creates the exporter configured by name
+func NewExporter(name string, cfg Configuration) (MetricsExporter, error) {
+	switch name {
+	case "zabbix":
+		return NewZabbixExporter(cfg), nil
+	case "statsd":
+		return NewStatsdExporter(cfg)
+	case "influxdb":
+		return NewInfluxExporter(cfg)
+	}
+	return nil, fmt.Errorf("unknown exporter '%s'", name)
+}
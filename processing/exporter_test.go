@@ -0,0 +1,61 @@
+package processing_test
+
+import (
+	"256bit.org/apache_logpipe/processing"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func init() {
+	SetupGlogForTests()
+}
+
+type recordingExporter struct {
+	name        string
+	discoveries []*processing.StatsSnapshot
+	data        []*processing.StatsSnapshot
+}
+
+func (c *recordingExporter) Name() string {
+	return c.name
+}
+
+func (c *recordingExporter) SendDiscovery(snapshot *processing.StatsSnapshot) {
+	c.discoveries = append(c.discoveries, snapshot)
+}
+
+func (c *recordingExporter) SendData(snapshot *processing.StatsSnapshot) {
+	c.data = append(c.data, snapshot)
+}
+
+func TestMultipleExporters(t *testing.T) {
+	assert := assert.New(t)
+	cfg := processing.NewConfiguration()
+	cfg.Exporters = []string{}
+	requestAccounting := processing.NewRequestAccounting(*cfg)
+	first := &recordingExporter{name: "first"}
+	second := &recordingExporter{name: "second"}
+	requestAccounting.AddExporter(first)
+	requestAccounting.AddExporter(second)
+
+	processing.PerfSetChan <- processing.PerfSet{Domain: "dom1", Ident: "/foo", Time: "100", Code: 200}
+	processing.CompleteStream()
+	<-processing.CompleteChan
+
+	requestAccounting.AccountRequest("dom1", "/foo", "100", 200)
+	requestAccounting.SubmitData()
+
+	for _, exporter := range []*recordingExporter{first, second} {
+		assert.Len(exporter.discoveries, 2, exporter.name)
+		assert.Len(exporter.data, 2, exporter.name)
+		assert.Equal(int64(1), exporter.data[0].Stats["dom1"]["all"].Count, "snapshot is not modified by later requests")
+		assert.Equal(int64(2), exporter.data[1].Stats["dom1"]["all"].Count)
+	}
+	assert.Equal(int64(0), requestAccounting.GetFailedZabbixSends())
+}
+
+func TestUnknownExporter(t *testing.T) {
+	_, err := processing.NewExporter("carrier-pigeon", *processing.NewConfiguration())
+	assert.Error(t, err)
+}
@@ -0,0 +1,203 @@
+package processing
+
+import (
+	"strings"
+)
+
+// FastParser is a tokenizer for the vhost_combined_canonical log format which does not allocate memory,
+// lines which cannot be tokenized are handed over to the fallback parser
+type FastParser struct {
+	fallback LogLineParser
+	// the loglines are accounted like the default regex_logline does
+	defaultRegex bool
+}
+
+// NewFastParser creates a FastParser instance
+func NewFastParser(fallback LogLineParser) *FastParser {
+	return &FastParser{fallback: fallback}
+}
+
+// NewDefaultRegexFastParser creates a FastParser which accounts the loglines like the default regex_logline,
+// the vhost keeps the port and the lines which the regex may parse differently are handed over to the fallback parser
+func NewDefaultRegexFastParser(fallback LogLineParser) *FastParser {
+	return &FastParser{fallback: fallback, defaultRegex: true}
+}
+
+// Parse returns the PerfSet of the logline
+func (c *FastParser) Parse(line string) (PerfSet, bool) {
+	perfSet, ok := tokenizeVhostCombinedCanonical(line, c.defaultRegex)
+	if ok {
+		return perfSet, true
+	}
+	return c.fallback.Parse(line)
+}
+
+// defaultRegexMethods are the request methods matched by the default regex_logline
+var defaultRegexMethods = map[string]bool{"GET": true, "POST": true, "PUT": true, "PROPFIND": true, "OPTIONS": true, "DELETE": true}
+
+// isIPv4 checks for four groups of digits like the default regex_logline
+func isIPv4(value string) bool {
+	for i := 0; i < 3; i++ {
+		pos := strings.IndexByte(value, '.')
+		if pos < 0 || !isDigits(value[:pos]) {
+			return false
+		}
+		value = value[pos+1:]
+	}
+	return isDigits(value)
+}
+
+func isDigits(value string) bool {
+	if len(value) == 0 {
+		return false
+	}
+	for i := 0; i < len(value); i++ {
+		if value[i] < '0' || value[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// nextToken returns the token up to the next space and the rest of the line after the space,
+// the token is empty if the line contains no space
+func nextToken(line string) (string, string) {
+	pos := strings.IndexByte(line, ' ')
+	if pos < 0 {
+		return "", line
+	}
+	return line[:pos], line[pos+1:]
+}
+
+// scanEscaped returns the length of the prefix without the stop characters, characters escaped
+// by a backslash are part of the prefix like apache escapes quotes and backslashes
+func scanEscaped(line string, stop string) int {
+	pos := 0
+	for pos < len(line) {
+		if line[pos] == '\\' {
+			// the regex of the log format does not match a escaped newline
+			if pos+1 >= len(line) || line[pos+1] == '\n' {
+				return pos
+			}
+			pos += 2
+			continue
+		}
+		if strings.IndexByte(stop, line[pos]) >= 0 {
+			return pos
+		}
+		pos++
+	}
+	return pos
+}
+
+// isDefaultRegexCode checks if a header starts like the code of the status, the greedy default regex_logline
+// would take the code from the header
+func isDefaultRegexCode(header string) bool {
+	return len(header) > 1 && header[0] == ' ' && header[1] >= '0' && header[1] <= '9'
+}
+
+// tokenizeVhostCombinedCanonical parses `%h %v:%p %l %u %t \"%r\" %>s %O \"%{Referer}i\" \"%{User-Agent}i\" %D`
+// and accepts exactly the lines which are matched by the regex of the log format,
+// defaultRegex rejects the lines which the default regex_logline may parse differently and keeps the port of the vhost
+func tokenizeVhostCombinedCanonical(line string, defaultRegex bool) (PerfSet, bool) {
+	// the fields of the default regex are delimited by any whitespace and its wildcards do not handle escapes
+	if defaultRegex && strings.ContainsAny(line, "\\\t\n\v\f\r") {
+		return PerfSet{}, false
+	}
+	// %h
+	host, line := nextToken(line)
+	if host == "" || (defaultRegex && !isIPv4(host)) {
+		return PerfSet{}, false
+	}
+
+	// %v:%p
+	vhost, line := nextToken(line)
+	portPos := strings.LastIndexByte(vhost, ':')
+	if portPos <= 0 || !isDigits(vhost[portPos+1:]) {
+		return PerfSet{}, false
+	}
+	domain := vhost[:portPos]
+	if defaultRegex {
+		domain = vhost
+	}
+
+	// %l %u
+	for i := 0; i < 2; i++ {
+		var token string
+		if token, line = nextToken(line); token == "" {
+			return PerfSet{}, false
+		}
+	}
+
+	// %t
+	pos := strings.IndexByte(line, ']')
+	if pos < 2 || line[0] != '[' || !strings.HasPrefix(line[pos:], `] "`) {
+		return PerfSet{}, false
+	}
+	timestamp := line[1:pos]
+	// the default regex takes the timestamp from the last opening bracket
+	if defaultRegex && strings.IndexByte(timestamp, '[') >= 0 {
+		return PerfSet{}, false
+	}
+	line = line[pos+3:]
+
+	// %r
+	method, line := nextToken(line)
+	if method == "" || strings.IndexByte(method, '"') >= 0 || (defaultRegex && !defaultRegexMethods[method]) {
+		return PerfSet{}, false
+	}
+	pos = scanEscaped(line, ` ?"`)
+	uri := line[:pos]
+	line = line[pos:]
+	if strings.HasPrefix(line, "?") {
+		line = line[1+scanEscaped(line[1:], ` "`):]
+	}
+	// the default regex needs a absolute uri and the protocol
+	if defaultRegex && (len(uri) == 0 || uri[0] != '/' || !strings.HasPrefix(line, " HTTP")) {
+		return PerfSet{}, false
+	}
+	if strings.HasPrefix(line, " ") {
+		line = line[1+scanEscaped(line[1:], `"`):]
+	}
+	if !strings.HasPrefix(line, `" `) {
+		return PerfSet{}, false
+	}
+	line = line[2:]
+
+	// %>s
+	if len(line) < 4 || line[3] != ' ' || !isDigits(line[:3]) {
+		return PerfSet{}, false
+	}
+	code := int(line[0]-'0')*100 + int(line[1]-'0')*10 + int(line[2]-'0')
+
+	// %O
+	size, line := nextToken(line[4:])
+	if !isDigits(size) {
+		return PerfSet{}, false
+	}
+
+	// %{Referer}i %{User-Agent}i
+	for i := 0; i < 2; i++ {
+		if !strings.HasPrefix(line, `"`) {
+			return PerfSet{}, false
+		}
+		pos = 1 + scanEscaped(line[1:], `"`)
+		if !strings.HasPrefix(line[pos:], `" `) || (defaultRegex && isDefaultRegexCode(line[1:pos])) {
+			return PerfSet{}, false
+		}
+		line = line[pos+2:]
+	}
+
+	// %D
+	if !isDigits(line) {
+		return PerfSet{}, false
+	}
+
+	return PerfSet{
+		Domain:    domain,
+		Ident:     uri,
+		Time:      line,
+		Code:      code,
+		Timestamp: timestamp,
+	}, true
+}
@@ -0,0 +1,230 @@
+package processing_test
+
+import (
+	"256bit.org/apache_logpipe/processing"
+	"bufio"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func init() {
+	SetupGlogForTests()
+}
+
+func readTestLoglines(t testing.TB) []string {
+	f, err := os.Open(GetProjectBaseDir() + "/testdata/test_access_log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return lines
+}
+
+func newLogFormatRegexParser(t testing.TB) processing.LogLineParser {
+	expr, timeFactor, err := processing.CompileLogFormat("vhost_combined_canonical")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parser, err := processing.NewRegexParser(expr, timeFactor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parser
+}
+
+type failingParser struct {
+	calls int
+}
+
+func (c *failingParser) Parse(line string) (processing.PerfSet, bool) {
+	c.calls++
+	return processing.PerfSet{}, false
+}
+
+func TestFastParserEqualsRegexParser(t *testing.T) {
+	assert := assert.New(t)
+	regexParser := newLogFormatRegexParser(t)
+	fastParser := processing.NewFastParser(&failingParser{})
+
+	lines := append(readTestLoglines(t),
+		`127.0.0.1 foo.bar.com:443 - - [07/Apr/2020:05:17:15 +0200] "GET " 400 0 "-" "-" 26`,
+		`::1 foo.bar.com:80 - jdoe [07/Apr/2020:05:17:15 +0200] "HEAD / HTTP/1.0" 304 0 "-" "curl" 0`,
+		`127.0.0.1 foo.bar.com:80 - - [07/Apr/2020:05:17:15 +0200] "GET /a\"b?x=\" HTTP/1.1" 200 538 "-" "-" 1234`,
+	)
+	for _, line := range lines {
+		expected, expectedOk := regexParser.Parse(line)
+		perfSet, ok := fastParser.Parse(line)
+		assert.Equal(expectedOk, ok, line)
+		assert.Equal(expected, perfSet, line)
+	}
+}
+
+func TestFastParserFallback(t *testing.T) {
+	assert := assert.New(t)
+	fallback := &failingParser{}
+	fastParser := processing.NewFastParser(fallback)
+
+	for _, line := range []string{
+		"",
+		"garbage",
+		`127.0.0.1 foo.bar.com - - [07/Apr/2020:05:17:15 +0200] "GET / HTTP/1.1" 200 538 "-" "-" 26`,
+		`127.0.0.1 foo.bar.com:443 - - [07/Apr/2020:05:17:15 +0200] "-" 408 0 "-" "-" 26`,
+		`127.0.0.1 foo.bar.com:443 - - [07/Apr/2020:05:17:15 +0200] "GET / HTTP/1.1" 200 538 "-" "-" -`,
+		`127.0.0.1 foo.bar.com:443 - -538[07/Apr/2020:05:17:15 +0200] "GET / HTTP/1.1" 200 538 "-" "-" 26`,
+		`127.0.0.1 foo.bar.com:443 - - [07/Apr/2020:05:17:15 +0200] "GET / HTTP/1.1" 200 538 "-" 127.0.0.1 26`,
+	} {
+		_, ok := fastParser.Parse(line)
+		assert.False(ok, line)
+	}
+	assert.Equal(7, fallback.calls)
+}
+
+func TestFastParserEscapedQuotes(t *testing.T) {
+	fastParser := processing.NewFastParser(&failingParser{})
+	perfSet, ok := fastParser.Parse(`127.0.0.1 foo.bar.com:80 - - [07/Apr/2020:05:17:15 +0200] "GET /a\"b?x=\" HTTP/1.1" 200 538 "-" "-" 1234`)
+	assert.True(t, ok)
+	assert.Equal(t, processing.PerfSet{Domain: "foo.bar.com", Ident: `/a\"b`, Time: "1234", Code: 200, Timestamp: "07/Apr/2020:05:17:15 +0200"}, perfSet)
+}
+
+func TestFastParserConfiguration(t *testing.T) {
+	cfg := processing.NewConfiguration()
+	cfg.LogFormat = "vhost_combined_canonical"
+	parser, err := processing.NewLogLineParser(*cfg)
+	assert.NoError(t, err)
+	assert.IsType(t, &processing.FastParser{}, parser)
+
+	parser, err = processing.NewLogLineParser(*processing.NewConfiguration())
+	assert.NoError(t, err)
+	assert.IsType(t, &processing.FastParser{}, parser, "the default regex_logline parses the same log format")
+
+	cfg = processing.NewConfiguration()
+	cfg.TimeUnit = "ms"
+	parser, err = processing.NewLogLineParser(*cfg)
+	assert.NoError(t, err)
+	assert.IsType(t, &processing.RegexParser{}, parser)
+}
+
+func TestDefaultRegexFastParserEqualsRegexParser(t *testing.T) {
+	assert := assert.New(t)
+	regexParser, err := processing.NewRegexParser(processing.NewConfiguration().RegexLogLineString, 1)
+	assert.NoError(err)
+	fastParser := processing.NewDefaultRegexFastParser(regexParser)
+	fallback := &failingParser{}
+	tokenizer := processing.NewDefaultRegexFastParser(fallback)
+
+	lines := append(readTestLoglines(t),
+		`127.0.0.1 foo.bar.com:443 - - [07/Apr/2020:05:17:15 +0200] "GET " 400 0 "-" "-" 26`,
+		`::1 foo.bar.com:80 - jdoe [07/Apr/2020:05:17:15 +0200] "GET / HTTP/1.0" 304 0 "-" "curl" 0`,
+		`127.0.0.1 foo.bar.com:80 - - [07/Apr/2020:05:17:15 +0200] "HEAD / HTTP/1.0" 200 0 "-" "curl" 0`,
+		`127.0.0.1 foo.bar.com:80 - - [07/Apr/2020:05:17:15 +0200] "GET *" 200 0 "-" "curl" 0`,
+		`127.0.0.1 foo.bar.com:80 - - [07/Apr/2020:05:17:15 +0200] "GET /a\"b HTTP/1.1" 200 0 "-" "x\" 404 y" 12`,
+	)
+	for _, line := range lines {
+		expected, expectedOk := regexParser.Parse(line)
+		perfSet, ok := fastParser.Parse(line)
+		assert.Equal(expectedOk, ok, line)
+		assert.Equal(expected, perfSet, line)
+	}
+	for _, line := range readTestLoglines(t)[:10] {
+		perfSet, ok := tokenizer.Parse(line)
+		assert.True(ok, line)
+		assert.Contains(perfSet.Domain, ":", "the vhost keeps the port like the default regex")
+	}
+	assert.Equal(0, fallback.calls, "the loglines of the default format are tokenized")
+}
+
+func benchmarkParser(b *testing.B, parser processing.LogLineParser) {
+	lines := readTestLoglines(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		parser.Parse(lines[i%len(lines)])
+	}
+}
+
+func BenchmarkDefaultRegexParser(b *testing.B) {
+	parser, err := processing.NewRegexParser(processing.NewConfiguration().RegexLogLineString, 1)
+	if err != nil {
+		b.Fatal(err)
+	}
+	benchmarkParser(b, parser)
+}
+
+func BenchmarkDefaultParser(b *testing.B) {
+	parser, err := processing.NewLogLineParser(*processing.NewConfiguration())
+	if err != nil {
+		b.Fatal(err)
+	}
+	benchmarkParser(b, parser)
+}
+
+func BenchmarkLogFormatRegexParser(b *testing.B) {
+	benchmarkParser(b, newLogFormatRegexParser(b))
+}
+
+func BenchmarkFastParser(b *testing.B) {
+	benchmarkParser(b, processing.NewFastParser(newLogFormatRegexParser(b)))
+}
+
+// mutateLogline inserts, deletes or replaces random parts of a logline, the fragments are the
+// delimiters of the log format which make a tokenizer and a regex disagree
+func mutateLogline(random *rand.Rand, line string) string {
+	fragments := []string{" ", "  ", `"`, `\`, `\"`, "[", "]", `] "`, `" `, ":", ":80", "?", "-", "0", " 404 ",
+		"GET ", "HEAD ", "/", " HTTP/1.1", "\t", "\n", "x", "127.0.0.1", "\xff"}
+	for n := random.Intn(3) + 1; n > 0; n-- {
+		pos := random.Intn(len(line) + 1)
+		switch random.Intn(3) {
+		case 0:
+			line = line[:pos] + fragments[random.Intn(len(fragments))] + line[pos:]
+		case 1:
+			end := pos + random.Intn(4)
+			if end > len(line) {
+				end = len(line)
+			}
+			line = line[:pos] + line[end:]
+		default:
+			if pos < len(line) {
+				line = line[:pos] + fragments[random.Intn(len(fragments))] + line[pos+1:]
+			}
+		}
+	}
+	return line
+}
+
+func TestFastParserRandomLoglines(t *testing.T) {
+	assert := assert.New(t)
+	regexParser := newLogFormatRegexParser(t)
+	fastParser := processing.NewFastParser(&failingParser{})
+	defaultRegexParser, err := processing.NewRegexParser(processing.NewConfiguration().RegexLogLineString, 1)
+	assert.NoError(err)
+	defaultRegexFastParser := processing.NewDefaultRegexFastParser(&failingParser{})
+
+	lines := append(readTestLoglines(t)[:20],
+		`127.0.0.1 foo.bar.com:80 - - [07/Apr/2020:05:17:15 +0200] "GET /a\"b?x=\" HTTP/1.1" 200 538 "-" "-" 1234`,
+		`127.0.0.1 foo.bar.com:80 - - [07/Apr/2020:05:17:15 +0200] "GET /a?b=c HTTP/1.1" 200 538 "http://foo/" "curl/7.68.0" 1234`,
+	)
+	random := rand.New(rand.NewSource(1))
+	for i := 0; i < 50000; i++ {
+		line := mutateLogline(random, lines[random.Intn(len(lines))])
+		expected, expectedOk := regexParser.Parse(line)
+		perfSet, ok := fastParser.Parse(line)
+		if !assert.Equal(expectedOk, ok, line) || !assert.Equal(expected, perfSet, line) {
+			return
+		}
+		// the lines which are not tokenized are parsed by the default regex
+		if perfSet, ok := defaultRegexFastParser.Parse(line); ok {
+			expected, expectedOk := defaultRegexParser.Parse(line)
+			if !assert.True(expectedOk, line) || !assert.Equal(expected, perfSet, line) {
+				return
+			}
+		}
+	}
+}
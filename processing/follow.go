@@ -0,0 +1,263 @@
+package processing
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const followStateVersion = 1
+
+// FileFollower reads the lines appended to files similar to 'tail -F',
+// rotated and truncated files are detected and the read offsets survive restarts by a state file
+type FileFollower struct {
+	files        []*followedFile
+	stateFile    string
+	pollInterval time.Duration
+	checkpoint   func()
+	buf          []byte
+	stop         chan bool
+	stopped      chan bool
+}
+
+type followedFile struct {
+	path    string
+	file    *os.File
+	info    os.FileInfo
+	offset  int64
+	partial []byte
+	resumed bool
+}
+
+type followFileState struct {
+	Inode  uint64 `json:"inode"`
+	Offset int64  `json:"offset"`
+}
+
+type followState struct {
+	Version int                        `json:"version"`
+	Files   map[string]followFileState `json:"files"`
+}
+
+// NewFileFollower creates a FileFollower instance, stateFile may be empty to disable the persistence of offsets
+func NewFileFollower(paths []string, stateFile string, pollInterval time.Duration) *FileFollower {
+	follower := &FileFollower{
+		stateFile:    stateFile,
+		pollInterval: pollInterval,
+		buf:          make([]byte, 65536),
+		stop:         make(chan bool),
+		stopped:      make(chan bool),
+	}
+	for _, path := range paths {
+		follower.files = append(follower.files, &followedFile{path: path})
+	}
+	return follower
+}
+
+// SetCheckpoint sets a function which is called before the offsets are persisted, it returns when
+// the lines which were delivered to the handler are processed, otherwise a crash would lose these lines
+func (c *FileFollower) SetCheckpoint(checkpoint func()) {
+	c.checkpoint = checkpoint
+}
+
+func (c *FileFollower) loadState() followState {
+	state := followState{Version: followStateVersion, Files: map[string]followFileState{}}
+	if c.stateFile == "" {
+		return state
+	}
+	data, err := os.ReadFile(c.stateFile)
+	if os.IsNotExist(err) {
+		return state
+	}
+	if err != nil {
+		glog.Errorf("unable to read follow state file %s: %s", c.stateFile, err.Error())
+		return state
+	}
+	var loaded followState
+	if err = json.Unmarshal(data, &loaded); err != nil || loaded.Version != followStateVersion || loaded.Files == nil {
+		glog.Errorf("ignoring invalid follow state file %s", c.stateFile)
+		return state
+	}
+	return loaded
+}
+
+func (c *FileFollower) saveState() {
+	if c.stateFile == "" {
+		return
+	}
+	if c.checkpoint != nil {
+		c.checkpoint()
+	}
+	state := followState{Version: followStateVersion, Files: map[string]followFileState{}}
+	for _, f := range c.files {
+		if f.info == nil {
+			continue
+		}
+		state.Files[f.path] = followFileState{Inode: fileInode(f.info), Offset: f.offset - int64(len(f.partial))}
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		glog.Fatalf("unable to marshal follow state: %s", err.Error())
+	}
+	if err = WriteFileAtomic(c.stateFile, data); err != nil {
+		glog.Errorf("unable to write follow state file %s: %s", c.stateFile, err.Error())
+	}
+}
+
+// WriteFileAtomic replaces a file by writing a temporary file which is renamed afterwards
+func WriteFileAtomic(filename string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
+
+// open opens the file, the first open resumes at the persisted offset or the end of the file,
+// files which appear after a rotation or after the start are read from the beginning
+func (c *FileFollower) open(f *followedFile, state followState) bool {
+	file, err := os.Open(f.path)
+	if err != nil {
+		glog.V(1).Infof("unable to open followed file %s: %s", f.path, err.Error())
+		f.resumed = true
+		return false
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		glog.Errorf("unable to stat followed file %s: %s", f.path, err.Error())
+		return false
+	}
+	offset := int64(0)
+	if !f.resumed {
+		offset = info.Size()
+		if saved, ok := state.Files[f.path]; ok && saved.Inode == fileInode(info) && saved.Offset <= info.Size() {
+			offset = saved.Offset
+		}
+		f.resumed = true
+	}
+	if _, err = file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		glog.Errorf("unable to seek followed file %s: %s", f.path, err.Error())
+		return false
+	}
+	glog.Infof("following file %s at offset %d", f.path, offset)
+	f.file = file
+	f.info = info
+	f.offset = offset
+	f.partial = nil
+	return true
+}
+
+// read delivers all complete lines which were appended since the last read
+func (c *FileFollower) read(f *followedFile, handler func(line string)) bool {
+	readData := false
+	for {
+		n, err := f.file.Read(c.buf)
+		if n > 0 {
+			readData = true
+			f.offset += int64(n)
+			data := append(f.partial, c.buf[:n]...)
+			for {
+				pos := bytes.IndexByte(data, '\n')
+				if pos < 0 {
+					break
+				}
+				handler(string(data[:pos]))
+				data = data[pos+1:]
+			}
+			f.partial = append([]byte{}, data...)
+		}
+		if err != nil {
+			if err != io.EOF {
+				glog.Errorf("unable to read followed file %s: %s", f.path, err.Error())
+			}
+			return readData
+		}
+	}
+}
+
+func (c *FileFollower) poll(f *followedFile, state followState, handler func(line string)) bool {
+	if f.file == nil && !c.open(f, state) {
+		return false
+	}
+	changed := c.read(f, handler)
+
+	if info, err := f.file.Stat(); err == nil && info.Size() < f.offset {
+		glog.Infof("followed file %s was truncated, reading from the beginning", f.path)
+		f.file.Seek(0, io.SeekStart)
+		f.offset = 0
+		f.partial = nil
+		c.read(f, handler)
+		return true
+	}
+
+	pathInfo, err := os.Stat(f.path)
+	if err != nil || os.SameFile(pathInfo, f.info) {
+		return changed
+	}
+	glog.Infof("followed file %s was rotated, opening the new file", f.path)
+	// read the lines which were written to the rotated file in the meantime
+	c.read(f, handler)
+	if len(f.partial) > 0 {
+		handler(string(f.partial))
+		f.partial = nil
+	}
+	f.file.Close()
+	f.file = nil
+	if c.open(f, state) {
+		c.read(f, handler)
+	}
+	return true
+}
+
+// Follow delivers the lines of all files to the handler until Stop is called
+func (c *FileFollower) Follow(handler func(line string)) {
+	defer close(c.stopped)
+	state := c.loadState()
+	for {
+		changed := false
+		for _, f := range c.files {
+			if c.poll(f, state, handler) {
+				changed = true
+			}
+		}
+		if changed {
+			c.saveState()
+		}
+		select {
+		case <-c.stop:
+			c.saveState()
+			for _, f := range c.files {
+				if f.file != nil {
+					f.file.Close()
+				}
+			}
+			return
+		case <-time.After(c.pollInterval):
+		}
+	}
+}
+
+// Stop terminates following and persists the offsets
+func (c *FileFollower) Stop() {
+	c.stop <- true
+	<-c.stopped
+}
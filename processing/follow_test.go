@@ -0,0 +1,143 @@
+package processing_test
+
+import (
+	"256bit.org/apache_logpipe/processing"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func init() {
+	SetupGlogForTests()
+}
+
+type lineCollector struct {
+	mutex sync.Mutex
+	lines []string
+}
+
+func (c *lineCollector) handle(line string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.lines = append(c.lines, line)
+}
+
+// waitFor waits until the expected number of lines was collected
+func (c *lineCollector) waitFor(count int) []string {
+	for i := 0; i < 200; i++ {
+		c.mutex.Lock()
+		if len(c.lines) >= count {
+			lines := append([]string{}, c.lines...)
+			c.mutex.Unlock()
+			return lines
+		}
+		c.mutex.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([]string{}, c.lines...)
+}
+
+func appendToFile(t *testing.T, filename string, data string) {
+	f, err := os.OpenFile(filename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err = f.WriteString(data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func startFollower(logfile string, stateFile string) (*processing.FileFollower, *lineCollector) {
+	collector := &lineCollector{}
+	follower := processing.NewFileFollower([]string{logfile}, stateFile, 10*time.Millisecond)
+	go follower.Follow(collector.handle)
+	// give the follower the chance to open the file at its end
+	time.Sleep(50 * time.Millisecond)
+	return follower, collector
+}
+
+func TestFollowRotation(t *testing.T) {
+	assert := assert.New(t)
+	testDir := SetupLogfileTestDir()
+	defer RemoveTestDir(testDir)
+	logfile := testDir + "/access.log"
+
+	appendToFile(t, logfile, "old line\n")
+	follower, collector := startFollower(logfile, "")
+
+	appendToFile(t, logfile, "line1\nline2 ")
+	assert.Equal([]string{"line1"}, collector.waitFor(1), "lines before the start are skipped, partial lines are delayed")
+
+	// rotate by rename, the old file receives a late write
+	assert.NoError(os.Rename(logfile, logfile+".1"))
+	appendToFile(t, logfile+".1", "continued\n")
+	appendToFile(t, logfile, "line3\n")
+	assert.Equal([]string{"line1", "line2 continued", "line3"}, collector.waitFor(3))
+
+	// rotate by truncation
+	assert.NoError(os.Truncate(logfile, 0))
+	appendToFile(t, logfile, "l4\n")
+	assert.Equal([]string{"line1", "line2 continued", "line3", "l4"}, collector.waitFor(4))
+	follower.Stop()
+}
+
+func TestFollowStateFile(t *testing.T) {
+	assert := assert.New(t)
+	testDir := SetupLogfileTestDir()
+	defer RemoveTestDir(testDir)
+	logfile := testDir + "/access.log"
+	stateFile := testDir + "/follow.state"
+
+	appendToFile(t, logfile, "old line\n")
+	follower, collector := startFollower(logfile, stateFile)
+	appendToFile(t, logfile, "line1\n")
+	assert.Equal([]string{"line1"}, collector.waitFor(1))
+	follower.Stop()
+	assert.FileExists(stateFile)
+
+	appendToFile(t, logfile, "line2\n")
+	follower, collector = startFollower(logfile, stateFile)
+	assert.Equal([]string{"line2"}, collector.waitFor(1), "offset restored from the state file")
+	follower.Stop()
+}
+
+func TestFollowMissingFile(t *testing.T) {
+	assert := assert.New(t)
+	testDir := SetupLogfileTestDir()
+	defer RemoveTestDir(testDir)
+	logfile := testDir + "/access.log"
+
+	follower, collector := startFollower(logfile, "")
+	appendToFile(t, logfile, "line1\nline2\n")
+	assert.Equal([]string{"line1", "line2"}, collector.waitFor(2), "a file which appears after the start is read from the beginning")
+	follower.Stop()
+}
+
+func TestFollowCheckpoint(t *testing.T) {
+	assert := assert.New(t)
+	testDir := SetupLogfileTestDir()
+	defer RemoveTestDir(testDir)
+	logfile := testDir + "/access.log"
+	stateFile := testDir + "/follow.state"
+
+	appendToFile(t, logfile, "old line\n")
+	collector := &lineCollector{}
+	follower := processing.NewFileFollower([]string{logfile}, stateFile, 10*time.Millisecond)
+	release := make(chan bool)
+	follower.SetCheckpoint(func() { <-release })
+	go follower.Follow(collector.handle)
+	time.Sleep(50 * time.Millisecond)
+
+	appendToFile(t, logfile, "line1\n")
+	assert.Equal([]string{"line1"}, collector.waitFor(1))
+	assert.NoFileExists(stateFile, "the offsets are not persisted before the lines are processed")
+	close(release)
+	follower.Stop()
+	assert.FileExists(stateFile)
+}
@@ -0,0 +1,90 @@
+package processing
+
+import (
+	"math"
+	"math/bits"
+	"sort"
+	"strconv"
+)
+
+// histogramSubBucketBits defines the precision of the histogram, values are stored
+// in buckets with a relative width of 1/128, which limits the error of a quantile to 0.4%
+const histogramSubBucketBits = 7
+
+// latencyHistogram is a sparse log-linear histogram (comparable to a HDR histogram)
+// which estimates quantiles of response times in constant memory per distinct magnitude
+type latencyHistogram struct {
+	counts map[int]int64
+	total  int64
+}
+
+func newLatencyHistogram() *latencyHistogram {
+	return &latencyHistogram{counts: map[int]int64{}}
+}
+
+func histogramBucket(value int64) int {
+	if value < 1<<histogramSubBucketBits {
+		if value < 0 {
+			return 0
+		}
+		return int(value)
+	}
+	exponent := bits.Len64(uint64(value)) - 1
+	mantissa := value >> uint(exponent-histogramSubBucketBits)
+	return (exponent-histogramSubBucketBits+1)<<histogramSubBucketBits + int(mantissa) - 1<<histogramSubBucketBits
+}
+
+// histogramBucketValue returns the middle of the value range of a bucket
+func histogramBucketValue(bucket int) int64 {
+	if bucket < 1<<histogramSubBucketBits {
+		return int64(bucket)
+	}
+	shift := uint(bucket>>histogramSubBucketBits - 1)
+	mantissa := int64(bucket&(1<<histogramSubBucketBits-1) + 1<<histogramSubBucketBits)
+	lower := mantissa << shift
+	upper := (mantissa+1)<<shift - 1
+	return (lower + upper) / 2
+}
+
+func (c *latencyHistogram) add(value int64) {
+	c.counts[histogramBucket(value)]++
+	c.total++
+}
+
+func (c *latencyHistogram) reset() {
+	c.counts = map[int]int64{}
+	c.total = 0
+}
+
+// quantiles estimates the values of the given percentiles, the result is empty without values
+func (c *latencyHistogram) quantiles(percentiles []float64) map[string]int64 {
+	result := map[string]int64{}
+	if c.total == 0 {
+		return result
+	}
+	var buckets []int
+	for bucket := range c.counts {
+		buckets = append(buckets, bucket)
+	}
+	sort.Ints(buckets)
+	for _, percentile := range percentiles {
+		rank := int64(math.Ceil(percentile / 100 * float64(c.total)))
+		if rank < 1 {
+			rank = 1
+		}
+		var seen int64
+		for _, bucket := range buckets {
+			seen += c.counts[bucket]
+			if seen >= rank {
+				result[PercentileName(percentile)] = histogramBucketValue(bucket)
+				break
+			}
+		}
+	}
+	return result
+}
+
+// PercentileName returns the name of a percentile used in metrics, i.e. "p99" or "p99.9"
+func PercentileName(percentile float64) string {
+	return "p" + strconv.FormatFloat(percentile, 'f', -1, 64)
+}
@@ -0,0 +1,50 @@
+package processing_test
+
+import (
+	"256bit.org/apache_logpipe/processing"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func init() {
+	SetupGlogForTests()
+}
+
+func TestPercentiles(t *testing.T) {
+	assert := assert.New(t)
+	cfg := processing.NewConfiguration()
+	cfg.Exporters = []string{}
+	cfg.Percentiles = []float64{50, 90, 99, 99.9}
+	requestAccounting := processing.NewRequestAccounting(*cfg)
+	exporter := &recordingExporter{name: "recorder"}
+	requestAccounting.AddExporter(exporter)
+	processing.CompleteStream()
+	<-processing.CompleteChan
+
+	// 1ms ... 1000ms
+	for i := 1; i <= 1000; i++ {
+		requestAccounting.AccountRequest("dom1", "/foo", fmt.Sprintf("%d", i*1000), 200)
+	}
+	requestAccounting.SubmitData()
+	percentiles := exporter.data[1].Stats["dom1"]["all"].Percentiles
+	assert.Len(percentiles, 4)
+	for name, expected := range map[string]float64{"p50": 500000, "p90": 900000, "p99": 990000, "p99.9": 999000} {
+		assert.InEpsilon(expected, float64(percentiles[name]), 0.004, name)
+	}
+
+	// percentiles are calculated per sending interval
+	requestAccounting.AccountRequest("dom1", "/foo", "42", 200)
+	requestAccounting.SubmitData()
+	assert.Equal(map[string]int64{"p50": 42, "p90": 42, "p99": 42, "p99.9": 42}, exporter.data[2].Stats["dom1"]["all"].Percentiles)
+
+	requestAccounting.SubmitData()
+	assert.Empty(exporter.data[3].Stats["dom1"]["all"].Percentiles, "no requests in the last interval")
+	assert.Contains(requestAccounting.GetJsonStats(), `"Percentiles": {}`)
+}
+
+func TestPercentileName(t *testing.T) {
+	assert.Equal(t, "p99", processing.PercentileName(99))
+	assert.Equal(t, "p99.9", processing.PercentileName(99.9))
+}
@@ -0,0 +1,183 @@
+package processing
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const influxMeasurement = "apache_logpipe"
+
+const influxTimeout = 10 * time.Second
+
+var influxTagEscaper = strings.NewReplacer(`,`, `\,`, `=`, `\=`, ` `, `\ `)
+
+// InfluxExporter writes the statistics in the influxdb line protocol to the http write api and/or a file
+type InfluxExporter struct {
+	url         string
+	token       string
+	file        string
+	client      *http.Client
+	failedSends int64
+}
+
+// NewInfluxExporter creates a InfluxExporter instance
+func NewInfluxExporter(cfg Configuration) (*InfluxExporter, error) {
+	if cfg.InfluxURL == "" && cfg.InfluxFile == "" {
+		return nil, fmt.Errorf("influxdb exporter needs a url or a file")
+	}
+	return &InfluxExporter{
+		url:    cfg.InfluxURL,
+		token:  cfg.InfluxToken,
+		file:   cfg.InfluxFile,
+		client: &http.Client{Timeout: influxTimeout},
+	}, nil
+}
+
+// Name returns the name of the exporter
+func (c *InfluxExporter) Name() string {
+	return "influxdb"
+}
+
+// GetFailedSends Returns the number of failed deliveries
+func (c *InfluxExporter) GetFailedSends() int64 {
+	return atomic.LoadInt64(&c.failedSends)
+}
+
+// SendDiscovery is not needed for influxdb
+func (c *InfluxExporter) SendDiscovery(snapshot *StatsSnapshot) {
+}
+
+// influxTags formats the tag set of the name value pairs, tags with a empty value are invalid
+// in the line protocol and omitted
+func influxTags(tags ...string) string {
+	var result strings.Builder
+	for i := 0; i+1 < len(tags); i += 2 {
+		if tags[i+1] != "" {
+			fmt.Fprintf(&result, ",%s=%s", tags[i], influxTagEscaper.Replace(tags[i+1]))
+		}
+	}
+	return result.String()
+}
+
+// formatInfluxLines serializes the snapshot, one line per accounting set
+func formatInfluxLines(snapshot *StatsSnapshot) []byte {
+	var buf bytes.Buffer
+	timestamp := snapshot.Time.UnixNano()
+	for _, vhost := range sortedVhosts(snapshot.Stats) {
+		for _, accset := range sortedAccsets(snapshot.Stats[vhost]) {
+			accsetData := snapshot.Stats[vhost][accset]
+			fields := []string{
+				fmt.Sprintf("count=%di", accsetData.Count),
+				fmt.Sprintf("sum=%di", accsetData.Sum),
+				fmt.Sprintf("requests=%di", accsetData.Requests),
+				fmt.Sprintf("errors=%di", accsetData.Errors),
+			}
+			if accsetData.Count > 0 {
+				fields = append(fields, fmt.Sprintf("avg=%f", float64(accsetData.Sum)/float64(accsetData.Count)))
+			}
+
+			var classes []int
+			for class := range accsetData.Classes {
+				classes = append(classes, class)
+			}
+			sort.Ints(classes)
+			for _, class := range classes {
+				fields = append(fields, fmt.Sprintf("class_%d=%di", class, accsetData.Classes[class]))
+			}
+
+			var codes []int
+			for code := range accsetData.Codes {
+				codes = append(codes, code)
+			}
+			sort.Ints(codes)
+			for _, code := range codes {
+				fields = append(fields, fmt.Sprintf("code_%d=%di", code, accsetData.Codes[code]))
+			}
+
+			var codeClasses []string
+			for codeClass := range accsetData.CodeClasses {
+				codeClasses = append(codeClasses, codeClass)
+			}
+			sort.Strings(codeClasses)
+			for _, codeClass := range codeClasses {
+				fields = append(fields, fmt.Sprintf("code_%s=%di", codeClass, accsetData.CodeClasses[codeClass]))
+			}
+
+			var percentiles []string
+			for name := range accsetData.Percentiles {
+				percentiles = append(percentiles, name)
+			}
+			sort.Strings(percentiles)
+			for _, name := range percentiles {
+				fields = append(fields, fmt.Sprintf("%s=%di", name, accsetData.Percentiles[name]))
+			}
+			fmt.Fprintf(&buf, "%s%s %s %d\n", influxMeasurement, influxTags("vhost", vhost, "accset", accset), strings.Join(fields, ","), timestamp)
+		}
+	}
+	if buf.Len() > 0 {
+		fmt.Fprintf(&buf, "%s_cardinality dropped=%di,folded=%di %d\n", influxMeasurement, snapshot.Dropped, snapshot.Folded, timestamp)
+	}
+	return buf.Bytes()
+}
+
+// SendData writes the statistics of the snapshot
+func (c *InfluxExporter) SendData(snapshot *StatsSnapshot) {
+	data := formatInfluxLines(snapshot)
+	if len(data) == 0 {
+		return
+	}
+	if c.file != "" {
+		err := c.writeFile(data)
+		if err != nil {
+			glog.Errorf("unable to write influxdb data to %s: %s", c.file, err.Error())
+			atomic.AddInt64(&c.failedSends, 1)
+		}
+	}
+	if c.url != "" {
+		err := c.post(data)
+		if err != nil {
+			glog.Errorf("unable to send influxdb data to %s: %s", c.url, err.Error())
+			atomic.AddInt64(&c.failedSends, 1)
+		}
+	}
+}
+
+func (c *InfluxExporter) writeFile(data []byte) error {
+	f, err := os.OpenFile(c.file, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(data)
+	return err
+}
+
+func (c *InfluxExporter) post(data []byte) error {
+	req, err := http.NewRequest(http.MethodPost, c.url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if c.token != "" {
+		req.Header.Set("Authorization", "Token "+c.token)
+	}
+	res, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("http status %s - >>>%s<<<", res.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
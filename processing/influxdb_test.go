@@ -0,0 +1,78 @@
+package processing_test
+
+import (
+	"256bit.org/apache_logpipe/processing"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func init() {
+	SetupGlogForTests()
+}
+
+func TestInfluxExporter(t *testing.T) {
+	assert := assert.New(t)
+	testDir := SetupLogfileTestDir()
+	defer RemoveTestDir(testDir)
+
+	var received string
+	var authorization string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received = string(body)
+		authorization = r.Header.Get("Authorization")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	cfg := processing.NewConfiguration()
+	cfg.Exporters = []string{"influxdb"}
+	cfg.InfluxURL = server.URL + "/api/v2/write?org=test&bucket=test"
+	cfg.InfluxToken = "secret"
+	cfg.InfluxFile = testDir + "/stats.influx"
+	cfg.ResponstimeClasses = []int{0, 1000}
+	processing.NewRequestAccounting(*cfg)
+
+	processing.PerfSetChan <- processing.PerfSet{Domain: "foo bar,com", Ident: "/foo", Time: "500", Code: 200}
+	processing.PerfSetChan <- processing.PerfSet{Domain: "foo bar,com", Ident: "/foo", Time: "1500", Code: 404}
+	processing.CompleteStream()
+	<-processing.CompleteChan
+
+	expected := regexp.MustCompile(`^apache_logpipe,vhost=foo\\ bar\\,com,accset=all count=1i,sum=500i,requests=2i,errors=0i,avg=500.000000,class_0=1i,class_1000=0i,code_200=1i,code_404=1i,code_2xx=1i,code_4xx=1i,p50=500i,p90=500i,p99=500i \d+\napache_logpipe_cardinality dropped=0i,folded=0i \d+\n$`)
+	assert.Regexp(expected, received)
+	assert.Equal("Token secret", authorization)
+
+	data, err := os.ReadFile(cfg.InfluxFile)
+	assert.NoError(err)
+	assert.Equal(received, string(data))
+}
+
+func TestInfluxExporterEmptyVhost(t *testing.T) {
+	assert := assert.New(t)
+	testDir := SetupLogfileTestDir()
+	defer RemoveTestDir(testDir)
+
+	cfg := processing.NewConfiguration()
+	cfg.Exporters = []string{"influxdb"}
+	cfg.InfluxFile = testDir + "/stats.influx"
+	processing.NewRequestAccounting(*cfg)
+
+	processing.PerfSetChan <- processing.PerfSet{Domain: "", Ident: "/foo", Time: "500", Code: 200}
+	processing.CompleteStream()
+	<-processing.CompleteChan
+
+	data, err := os.ReadFile(cfg.InfluxFile)
+	assert.NoError(err)
+	assert.Regexp(`^apache_logpipe,accset=all count=1i,`, string(data), "the empty vhost tag is omitted")
+}
+
+func TestInfluxExporterWithoutTarget(t *testing.T) {
+	_, err := processing.NewInfluxExporter(*processing.NewConfiguration())
+	assert.Error(t, err)
+}
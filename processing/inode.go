@@ -0,0 +1,17 @@
+//go:build !windows
+// +build !windows
+
+package processing
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileInode returns the inode of a file, it identifies a file across renames
+func fileInode(info os.FileInfo) uint64 {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(stat.Ino)
+	}
+	return 0
+}
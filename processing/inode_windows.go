@@ -0,0 +1,10 @@
+package processing
+
+import (
+	"os"
+)
+
+// fileInode is not available on windows, offsets of followed files are only restored by the filename
+func fileInode(info os.FileInfo) uint64 {
+	return 0
+}
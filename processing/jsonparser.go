@@ -0,0 +1,112 @@
+package processing
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// JSONParser parses loglines which contain a json object, the fields are selected by dot separated paths
+type JSONParser struct {
+	domainPath    []string
+	uriPath       []string
+	codePath      []string
+	timePath      []string
+	timestampPath []string
+	timeFactor    float64
+}
+
+// NewJSONParser creates a JSONParser instance, timeFactor converts the time field to microseconds
+func NewJSONParser(domainPath string, uriPath string, codePath string, timePath string, timeFactor float64) (*JSONParser, error) {
+	for name, path := range map[string]string{"domain": domainPath, "uri": uriPath, "code": codePath, "time": timePath} {
+		if path == "" {
+			return nil, fmt.Errorf("json field path for '%s' is not configured", name)
+		}
+	}
+	return &JSONParser{
+		domainPath: strings.Split(domainPath, "."),
+		uriPath:    strings.Split(uriPath, "."),
+		codePath:   strings.Split(codePath, "."),
+		timePath:   strings.Split(timePath, "."),
+		timeFactor: timeFactor,
+	}, nil
+}
+
+// SetTimestampPath configures the dot separated path of the optional timestamp field
+func (c *JSONParser) SetTimestampPath(timestampPath string) {
+	c.timestampPath = nil
+	if timestampPath != "" {
+		c.timestampPath = strings.Split(timestampPath, ".")
+	}
+}
+
+// lookupJSONValue returns the value of a path as string, numbers are returned in their literal representation
+func lookupJSONValue(data map[string]interface{}, path []string) (string, bool) {
+	if len(path) == 0 {
+		return "", false
+	}
+	var value interface{} = data
+	for _, key := range path {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return "", false
+		}
+		value, ok = object[key]
+		if !ok {
+			return "", false
+		}
+	}
+	switch typedValue := value.(type) {
+	case string:
+		return typedValue, true
+	case json.Number:
+		return typedValue.String(), true
+	}
+	return "", false
+}
+
+// Parse returns the PerfSet of the logline
+func (c *JSONParser) Parse(line string) (PerfSet, bool) {
+	var data map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader([]byte(line)))
+	decoder.UseNumber()
+	if err := decoder.Decode(&data); err != nil {
+		glog.V(1).Infof("unable to decode json logline: %s", err.Error())
+		return PerfSet{}, false
+	}
+
+	domain, ok1 := lookupJSONValue(data, c.domainPath)
+	uri, ok2 := lookupJSONValue(data, c.uriPath)
+	codeString, ok3 := lookupJSONValue(data, c.codePath)
+	timeString, ok4 := lookupJSONValue(data, c.timePath)
+	if !ok1 || !ok2 || !ok3 || !ok4 {
+		glog.V(1).Infof("json logline does not provide all fields")
+		return PerfSet{}, false
+	}
+	code, err := strconv.Atoi(codeString)
+	if err != nil {
+		glog.V(1).Infof("unable to convert code '%s' to integer", codeString)
+		return PerfSet{}, false
+	}
+	time, ok := normalizeTime(timeString, c.timeFactor)
+	if !ok {
+		glog.V(1).Infof("unable to convert time '%s' to a number", timeString)
+		return PerfSet{}, false
+	}
+	if pos := strings.IndexByte(uri, '?'); pos >= 0 {
+		uri = uri[:pos]
+	}
+	// the timestamp is optional, it is only needed for the batch analysis
+	timestamp, _ := lookupJSONValue(data, c.timestampPath)
+	return PerfSet{
+		Domain:    domain,
+		Ident:     uri,
+		Time:      time,
+		Code:      code,
+		Timestamp: timestamp,
+	}, true
+}
@@ -0,0 +1,62 @@
+package processing_test
+
+import (
+	"256bit.org/apache_logpipe/processing"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func init() {
+	SetupGlogForTests()
+}
+
+func TestJSONParser(t *testing.T) {
+	assert := assert.New(t)
+	cfg := processing.NewConfiguration()
+	cfg.InputFormat = "json"
+	cfg.JSONURIPath = "request.uri"
+	cfg.JSONTimePath = "request.duration"
+	parser, err := processing.NewLogLineParser(*cfg)
+	assert.NoError(err)
+
+	perfSet, ok := parser.Parse(`{"vhost": "foo.bar.com", "status": 404, "request": {"uri": "/foo?bar=1", "duration": 1234}}`)
+	assert.True(ok)
+	assert.Equal(processing.PerfSet{Domain: "foo.bar.com", Ident: "/foo", Time: "1234", Code: 404}, perfSet)
+
+	perfSet, ok = parser.Parse(`{"vhost": "foo.bar.com", "status": "200", "request": {"uri": "/", "duration": "17"}}`)
+	assert.True(ok, "numbers as strings")
+	assert.Equal(processing.PerfSet{Domain: "foo.bar.com", Ident: "/", Time: "17", Code: 200}, perfSet)
+
+	for _, line := range []string{
+		`127.0.0.1 foo.bar.com:443 - - [07/Apr/2020:05:17:15 +0200] "GET / HTTP/1.1" 201 538 "-" "-" 26`,
+		`{"vhost": "foo.bar.com", "status": 200, "request": {"uri": "/"}}`,
+		`{"vhost": "foo.bar.com", "status": "OK", "request": {"uri": "/", "duration": 1}}`,
+		`{"vhost": "foo.bar.com", "status": 200, "request": "/"}`,
+		`{"vhost": "foo.bar.com", `,
+	} {
+		_, ok = parser.Parse(line)
+		assert.False(ok, line)
+	}
+}
+
+func TestJSONParserTimeUnit(t *testing.T) {
+	assert := assert.New(t)
+	cfg := processing.NewConfiguration()
+	cfg.InputFormat = "json"
+	cfg.TimeUnit = "s"
+	cfg.JSONTimePath = "request_time"
+	parser, err := processing.NewLogLineParser(*cfg)
+	assert.NoError(err)
+
+	perfSet, ok := parser.Parse(`{"vhost": "foo.bar.com", "uri": "/", "status": 200, "request_time": 0.5}`)
+	assert.True(ok)
+	assert.Equal("500000", perfSet.Time)
+}
+
+func TestUnknownInputFormat(t *testing.T) {
+	cfg := processing.NewConfiguration()
+	cfg.InputFormat = "xml"
+	_, err := processing.NewLogLineParser(*cfg)
+	assert.Error(t, err)
+}
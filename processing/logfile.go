@@ -1,15 +1,33 @@
 package processing
 
 import (
+	"compress/gzip"
+	"io"
 	"os"
+	"path/filepath"
+	"regexp"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/golang/glog"
+	"github.com/klauspost/compress/zstd"
 	"github.com/lestrrat-go/strftime"
 )
 
+// Supported compression methods for logfiles
+const (
+	CompressNone = "none"
+	CompressGzip = "gzip"
+	CompressZstd = "zstd"
+)
+
+// flushWriteCloser is implemented by the gzip and zstd writers
+type flushWriteCloser interface {
+	io.WriteCloser
+	Flush() error
+}
+
 // LogSink instance manages
 type LogSink struct {
 	FilenamePattern         string
@@ -17,6 +35,15 @@ type LogSink struct {
 	fileNamePatternStrftime *strftime.Strftime
 	CurrentFileName         string
 	fileDescriptor          *os.File
+	compressWriter          flushWriteCloser
+	lastFileName            string
+	Compression             string
+	CompressInline          bool
+	backgroundTasks         sync.WaitGroup
+	retentionMutex          sync.Mutex
+	RetentionMaxAge         time.Duration
+	RetentionMaxFiles       int
+	RetentionMaxTotalBytes  int64
 	LinesWritten            int64
 	logMessageChan          chan string
 	streamStatus            chan int64
@@ -47,6 +74,7 @@ func NewLogSink(pattern string, symlink string) *LogSink {
 
 	if singletonLogSink == nil {
 		singletonLogSink = new(LogSink)
+		singletonLogSink.Compression = CompressNone
 		singletonLogSink.logMessageChan = make(chan string, 1000)
 		singletonLogSink.streamStatus = make(chan int64, 1)
 		go singletonLogSink.persistLogLines()
@@ -64,8 +92,166 @@ func NewLogSink(pattern string, symlink string) *LogSink {
 	return singletonLogSink
 }
 
+// SetCompression configures the compression of logfiles, inline compresses the data while writing,
+// otherwise a logfile is compressed in the background after switching to the next logfile
+func (c *LogSink) SetCompression(method string, inline bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	switch method {
+	case "", CompressNone:
+		method = CompressNone
+	case CompressGzip, CompressZstd:
+	default:
+		glog.Fatalf("unknown compression method '%s'", method)
+	}
+	c.Compression = method
+	c.CompressInline = inline
+}
+
+// CompressionSuffix returns the filename suffix of a compression method
+func CompressionSuffix(method string) string {
+	switch method {
+	case CompressGzip:
+		return ".gz"
+	case CompressZstd:
+		return ".zst"
+	}
+	return ""
+}
+
+func newCompressWriter(w io.Writer, method string) flushWriteCloser {
+	switch method {
+	case CompressGzip:
+		return gzip.NewWriter(w)
+	case CompressZstd:
+		zw, err := zstd.NewWriter(w)
+		if err != nil {
+			glog.Fatal(err.Error())
+		}
+		return zw
+	}
+	return nil
+}
+
+// compressLogfile compresses a logfile and removes the uncompressed file,
+// if the compressed file already exists the data is appended as an additional stream.
+// The data is compressed to a temporary file which replaces the compressed file afterwards,
+// an interrupted compression leaves the uncompressed file and the previous compressed file intact
+func compressLogfile(filename string, method string) error {
+	src, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	compressedFilename := filename + CompressionSuffix(method)
+	tmp, err := os.OpenFile(compressedFilename+".tmp", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	if previous, err := os.Open(compressedFilename); err == nil {
+		_, err = io.Copy(tmp, previous)
+		previous.Close()
+		if err != nil {
+			return err
+		}
+	}
+	w := newCompressWriter(tmp, method)
+	if _, err = io.Copy(w, src); err != nil {
+		w.Close()
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		return err
+	}
+	// keep the modification time for the retention of logfiles
+	if info, err := src.Stat(); err == nil {
+		os.Chtimes(tmp.Name(), info.ModTime(), info.ModTime())
+	}
+	if err = os.Rename(tmp.Name(), compressedFilename); err != nil {
+		return err
+	}
+	return os.Remove(filename)
+}
+
+var strftimeVerbs = regexp.MustCompile(`%.`)
+
+// leftoverLogfiles returns the uncompressed logfiles of the filename pattern except the current logfile,
+// i.e. the logfile of the previous day which was written before a restart
+func (c *LogSink) leftoverLogfiles(currentFilename string) []string {
+	filenames, err := filepath.Glob(strftimeVerbs.ReplaceAllString(c.FilenamePattern, "*"))
+	if err != nil {
+		glog.Errorf("unable to find the logfiles of %s: %s", c.FilenamePattern, err.Error())
+		return nil
+	}
+	var leftovers []string
+	for _, filename := range filenames {
+		extension := filepath.Ext(filename)
+		if filename == currentFilename || extension == CompressionSuffix(CompressGzip) || extension == CompressionSuffix(CompressZstd) || extension == ".tmp" {
+			continue
+		}
+		if info, err := os.Lstat(filename); err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		leftovers = append(leftovers, filename)
+	}
+	return leftovers
+}
+
+// rotateInBackground compresses the previous logfile and removes expired logfiles,
+// the first logfile after a start also compresses the logfiles left uncompressed by a previous run
+func (c *LogSink) rotateInBackground(previousFilename string, currentFilename string) {
+	method := c.Compression
+	var compress []string
+	if !c.CompressInline && method != CompressNone {
+		if previousFilename == "" {
+			compress = c.leftoverLogfiles(currentFilename)
+		} else if previousFilename != currentFilename {
+			compress = []string{previousFilename}
+		}
+	}
+	if len(compress) == 0 && !c.retentionEnabled() {
+		return
+	}
+	c.backgroundTasks.Add(1)
+	go func() {
+		defer c.backgroundTasks.Done()
+		for _, filename := range compress {
+			glog.Infof("compressing logfile %s using %s", filename, method)
+			err := compressLogfile(filename, method)
+			if err != nil {
+				glog.Errorf("unable to compress logfile %s: %s", filename, err.Error())
+			}
+		}
+		c.pruneLogfiles(currentFilename)
+	}()
+}
+
+func (c *LogSink) closeFileDescriptor() {
+	if c.compressWriter != nil {
+		err := c.compressWriter.Close()
+		if err != nil {
+			glog.Errorf("unable to finish compression of %s: %s", c.CurrentFileName, err.Error())
+		}
+		c.compressWriter = nil
+	}
+	if c.fileDescriptor != nil {
+		c.fileDescriptor.Close()
+		c.fileDescriptor = nil
+	}
+}
+
 func (c *LogSink) getFileDescriptor() *os.File {
 	currentFilename := c.fileNamePatternStrftime.FormatString(time.Now())
+	if c.CompressInline {
+		currentFilename += CompressionSuffix(c.Compression)
+	}
 	if currentFilename != c.CurrentFileName {
 		var openFlags int
 		if FileExists(currentFilename) {
@@ -94,11 +280,15 @@ func (c *LogSink) getFileDescriptor() *os.File {
 			}
 		}
 
+		c.closeFileDescriptor()
 		c.CurrentFileName = currentFilename
-		if c.fileDescriptor != nil {
-			c.fileDescriptor.Close()
-		}
 		c.fileDescriptor = f
+		if c.CompressInline {
+			c.compressWriter = newCompressWriter(f, c.Compression)
+		}
+
+		c.rotateInBackground(c.lastFileName, currentFilename)
+		c.lastFileName = currentFilename
 	} else {
 		glog.V(2).Info("Reuse filedescriptor")
 	}
@@ -113,8 +303,7 @@ func (c *LogSink) SubmitLogLine(line string) {
 func (c *LogSink) closeLog() {
 	if c.fileDescriptor != nil {
 		glog.V(1).Infof("closing logfile %s", c.CurrentFileName)
-		c.fileDescriptor.Close()
-		c.fileDescriptor = nil
+		c.closeFileDescriptor()
 		c.CurrentFileName = ""
 	} else {
 		glog.Warningf("logfile %s already closed", c.CurrentFileName)
@@ -137,19 +326,28 @@ func (c *LogSink) persistLogLines() {
 
 		if line == "<COMMIT>" {
 			glog.Infof("commit logfile %s", c.CurrentFileName)
+			if c.compressWriter != nil {
+				c.compressWriter.Flush()
+			}
 			c.fileDescriptor.Sync()
 			c.streamStatus <- c.LinesWritten
 			continue
 		}
 
 		if line == "<TERMINATE>" {
+			c.backgroundTasks.Wait()
 			c.closeLog()
 			glog.Info("Stopping persister routine")
 			c.persisterActive = false
 			return
 		}
 
-		_, err := c.fileDescriptor.WriteString(line + "\n")
+		var err error
+		if c.compressWriter != nil {
+			_, err = io.WriteString(c.compressWriter, line+"\n")
+		} else {
+			_, err = c.fileDescriptor.WriteString(line + "\n")
+		}
 		if err != nil {
 			glog.Fatal(err)
 		}
@@ -171,6 +369,17 @@ func (c *LogSink) TerminateLogStream() {
 
 }
 
+// TerminateLogSink flushes and closes the logfile of the LogSink and waits for the compression
+// of rotated logfiles, it is used before the process terminates by a signal
+func TerminateLogSink() {
+	mu.Lock()
+	logSink := singletonLogSink
+	mu.Unlock()
+	if logSink != nil {
+		logSink.TerminateLogStream()
+	}
+}
+
 // CloseLogStream closes the logfile :-)
 func (c *LogSink) CloseLogStream() int64 {
 	mu.Lock()
@@ -2,7 +2,9 @@ package processing_test
 
 import (
 	"256bit.org/apache_logpipe/processing"
+	"compress/gzip"
 	"fmt"
+	"io"
 	"math/rand"
 	"os"
 	"regexp"
@@ -11,6 +13,7 @@ import (
 	"time"
 
 	"github.com/golang/glog"
+	"github.com/klauspost/compress/zstd"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -96,3 +99,115 @@ func TestConcurrentLogfile(t *testing.T) {
 	assert.Equal(int64((numberOfConcurrentThreads*numberOfLinesPerThread*2)+1+1), ls.LinesWritten)
 	ls.TerminateLogStream()
 }
+
+func readCompressedFile(t *testing.T, filename string, method string) string {
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var r io.Reader
+	switch method {
+	case processing.CompressGzip:
+		r, err = gzip.NewReader(f)
+	case processing.CompressZstd:
+		r, err = zstd.NewReader(f)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestInlineCompressedLogfile(t *testing.T) {
+	processing.DestroyLogSinkSingleton()
+	assert := assert.New(t)
+	testDir := SetupLogfileTestDir()
+	defer RemoveTestDir(testDir)
+
+	ls := processing.NewLogSink(testDir+"/apache_logpipe_test_inline_access.log_%Y-%m-%d", "")
+	ls.SetCompression(processing.CompressGzip, true)
+	ls.SubmitLogLine("TEST1")
+	ls.CommitLogStream()
+	filename := ls.CurrentFileName
+	assert.Regexp(regexp.MustCompile(`apache_logpipe_test_inline_access.log_....-..-..\.gz$`), filename)
+	ls.SubmitLogLine("TEST2")
+	ls.CloseLogStream()
+
+	// reopening the file appends an additional gzip stream
+	ls.SubmitLogLine("TEST3")
+	ls.CloseLogStream()
+	ls.TerminateLogStream()
+
+	assert.Equal("TEST1\nTEST2\nTEST3\n", readCompressedFile(t, filename, processing.CompressGzip))
+}
+
+func TestCompressAfterRotation(t *testing.T) {
+	processing.DestroyLogSinkSingleton()
+	assert := assert.New(t)
+	testDir := SetupLogfileTestDir()
+	defer RemoveTestDir(testDir)
+
+	// start at the beginning of a second to prevent unexpected rotations
+	time.Sleep(time.Until(time.Now().Truncate(time.Second).Add(time.Second)))
+	ls := processing.NewLogSink(testDir+"/apache_logpipe_test_rotation_access.log_%H-%M-%S", "")
+	ls.SetCompression(processing.CompressZstd, false)
+	ls.SubmitLogLine("TEST1")
+	ls.CommitLogStream()
+	firstFile := ls.CurrentFileName
+
+	// wait for the next second to force a new logfile
+	time.Sleep(1100 * time.Millisecond)
+	ls.SubmitLogLine("TEST2")
+	ls.CommitLogStream()
+	secondFile := ls.CurrentFileName
+	assert.NotEqual(firstFile, secondFile)
+	ls.TerminateLogStream()
+
+	assert.NoFileExists(firstFile)
+	assert.FileExists(firstFile + ".zst")
+	assert.Equal("TEST1\n", readCompressedFile(t, firstFile+".zst", processing.CompressZstd))
+}
+
+func TestTerminateLogSink(t *testing.T) {
+	processing.DestroyLogSinkSingleton()
+	assert := assert.New(t)
+	testDir := SetupLogfileTestDir()
+	defer RemoveTestDir(testDir)
+
+	ls := processing.NewLogSink(testDir+"/apache_logpipe_test_terminate_access.log_%Y-%m-%d", "")
+	ls.SetCompression(processing.CompressZstd, true)
+	ls.SubmitLogLine("TEST1")
+	ls.CommitLogStream()
+	filename := ls.CurrentFileName
+	ls.SubmitLogLine("TEST2")
+
+	// the buffered lines are written and the compressed stream is completed
+	processing.TerminateLogSink()
+	assert.Equal("TEST1\nTEST2\n", readCompressedFile(t, filename, processing.CompressZstd))
+}
+
+func TestCompressLeftoverLogfile(t *testing.T) {
+	processing.DestroyLogSinkSingleton()
+	assert := assert.New(t)
+	testDir := SetupLogfileTestDir()
+	defer RemoveTestDir(testDir)
+
+	leftover := testDir + "/apache_logpipe_test_leftover_access.log_2000-01-01"
+	assert.NoError(os.WriteFile(leftover, []byte("OLD\n"), 0644))
+	ls := processing.NewLogSink(testDir+"/apache_logpipe_test_leftover_access.log_%Y-%m-%d", "")
+	ls.SetCompression(processing.CompressGzip, false)
+	ls.SubmitLogLine("TEST1")
+	ls.CommitLogStream()
+	currentFile := ls.CurrentFileName
+	ls.TerminateLogStream()
+
+	assert.NoFileExists(leftover)
+	assert.NoFileExists(leftover + ".gz.tmp")
+	assert.Equal("OLD\n", readCompressedFile(t, leftover+".gz", processing.CompressGzip))
+	assert.FileExists(currentFile, "the current logfile is not compressed")
+}
@@ -0,0 +1,151 @@
+package processing
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// LogFormatPresets are named apache log formats which can be used instead of a literal LogFormat string
+var LogFormatPresets = map[string]string{
+	"vhost_combined_canonical": `%h %v:%p %l %u %t \"%r\" %>s %O \"%{Referer}i\" \"%{User-Agent}i\" %D`,
+	// nginx: log_format combined_host_time '$remote_addr - $remote_user [$time_local] "$request" $status
+	//        $body_bytes_sent "$http_referer" "$http_user_agent" $host $request_time';
+	"nginx_combined": `%h - %u %t \"%r\" %>s %b \"%{Referer}i\" \"%{User-Agent}i\" %v %{s}T`,
+}
+
+// logFormatField describes the regex of a apache LogFormat directive
+type logFormatField struct {
+	group string
+	regex string
+}
+
+var logFormatFields = map[byte]logFormatField{
+	'v': {"domain", `[^ ]+?`},
+	'V': {"domain", `[^ ]+?`},
+	// apache escapes quotes and backslashes of the request line by a backslash
+	'r': {"", `[^ "]+ (?P<uri>(?:[^ ?"\\]|\\.)*)(?:\?(?:[^ "\\]|\\.)*)?(?: (?:[^"\\]|\\.)*)?`},
+	'U': {"uri", `[^ ?"]*`},
+	's': {"code", `\d{3}`},
+	'D': {"time", `\d+`},
+	'T': {"time", `\d+(?:\.\d+)?`},
+	't': {"", `\[(?P<timestamp>[^\]]+)\]`},
+	'p': {"", `\d+`},
+	'b': {"", `[\d-]+`},
+	'B': {"", `\d+`},
+	'O': {"", `\d+`},
+	'I': {"", `\d+`},
+	'S': {"", `\d+`},
+	'h': {"", `[^ ]+`},
+	'a': {"", `[^ ]+`},
+	'A': {"", `[^ ]+`},
+	'l': {"", `[^ ]+`},
+	'u': {"", `[^ ]+`},
+	'H': {"", `[^ "]+`},
+	'm': {"", `[^ "]+`},
+	'q': {"", `[^ "]*`},
+	'f': {"", `[^ ]+`},
+	'k': {"", `\d+`},
+	'L': {"", `[^ ]+`},
+	'P': {"", `\d+`},
+	'R': {"", `[^ ]+`},
+	'X': {"", `[X+-]`},
+	'i': {"", `(?:[^"\\]|\\.)*`},
+	'o': {"", `(?:[^"\\]|\\.)*`},
+	'e': {"", `(?:[^"\\]|\\.)*`},
+	'n': {"", `(?:[^"\\]|\\.)*`},
+	'C': {"", `(?:[^"\\]|\\.)*`},
+}
+
+// logFormatTimeFactors converts the time directives to microseconds
+var logFormatTimeFactors = map[string]float64{
+	"D":   1,
+	"T":   1000000,
+	"sT":  1000000,
+	"msT": 1000,
+	"usT": 1,
+}
+
+var logFormatModifiers = regexp.MustCompile(`^!?[\d,]*[<>]?`)
+
+var logFormatEscapes = strings.NewReplacer(`\"`, `"`, `\t`, "\t", `\n`, "\n", `\\`, `\`)
+
+// CompileLogFormat converts a apache LogFormat string or the name of a preset to a regex
+// which provides the named groups domain, uri, code and time, timeFactor converts the time to microseconds
+func CompileLogFormat(format string) (string, float64, error) {
+	if preset, ok := LogFormatPresets[format]; ok {
+		format = preset
+	}
+	var expr strings.Builder
+	var literal strings.Builder
+	groups := map[string]bool{}
+	timeFactor := 1.0
+
+	expr.WriteString("^")
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			literal.WriteByte(format[i])
+			continue
+		}
+		i++
+		if i < len(format) && format[i] == '%' {
+			literal.WriteByte('%')
+			continue
+		}
+		expr.WriteString(regexp.QuoteMeta(logFormatEscapes.Replace(literal.String())))
+		literal.Reset()
+
+		i += len(logFormatModifiers.FindString(format[i:]))
+		param := ""
+		if i < len(format) && format[i] == '{' {
+			end := strings.IndexByte(format[i:], '}')
+			if end < 0 {
+				return "", 0, fmt.Errorf("unterminated parameter in log format at position %d", i)
+			}
+			param = format[i+1 : i+end]
+			i += end + 1
+		}
+		if i >= len(format) {
+			return "", 0, fmt.Errorf("incomplete directive at the end of the log format")
+		}
+		directive := format[i]
+		field, ok := logFormatFields[directive]
+		if !ok {
+			return "", 0, fmt.Errorf("unsupported log format directive '%%%c'", directive)
+		}
+		if directive == 't' && (param != "" || groups["timestamp"]) {
+			field.regex = `.+?`
+		}
+		if directive == 't' && param == "" {
+			groups["timestamp"] = true
+		}
+		if directive == 'r' && groups["uri"] {
+			field.regex = `[^"]*`
+		}
+		if field.group == "time" && !groups["time"] {
+			factor, ok := logFormatTimeFactors[param+string(directive)]
+			if !ok {
+				return "", 0, fmt.Errorf("unsupported time unit '%s' of directive '%%%c'", param, directive)
+			}
+			timeFactor = factor
+		}
+		if directive == 'r' {
+			groups["uri"] = true
+		}
+		if field.group != "" && !groups[field.group] {
+			groups[field.group] = true
+			fmt.Fprintf(&expr, "(?P<%s>%s)", field.group, field.regex)
+		} else {
+			fmt.Fprintf(&expr, "(?:%s)", field.regex)
+		}
+	}
+	expr.WriteString(regexp.QuoteMeta(logFormatEscapes.Replace(literal.String())))
+	expr.WriteString("$")
+
+	for _, group := range []string{"domain", "uri", "code", "time"} {
+		if !groups[group] {
+			return "", 0, fmt.Errorf("log format >>>%s<<< provides no %s, it needs %%v, %%r, %%>s and %%D or %%T", format, group)
+		}
+	}
+	return expr.String(), timeFactor, nil
+}
@@ -0,0 +1,85 @@
+package processing_test
+
+import (
+	"256bit.org/apache_logpipe/processing"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func init() {
+	SetupGlogForTests()
+}
+
+func TestLogFormatPreset(t *testing.T) {
+	assert := assert.New(t)
+	cfg := processing.NewConfiguration()
+	cfg.LogFormat = "vhost_combined_canonical"
+	parser, err := processing.NewLogLineParser(*cfg)
+	assert.NoError(err)
+
+	perfSet, ok := parser.Parse(`127.0.0.1 foo.bar.com:443 - - [07/Apr/2020:05:17:15 +0200] "GET /foo/bar?baz=1 HTTP/1.1" 201 538 "-" "Mozilla/4.0 (compatible; \"MSIE\" 7.0)" 26`)
+	assert.True(ok)
+	assert.Equal(processing.PerfSet{Domain: "foo.bar.com", Ident: "/foo/bar", Time: "26", Code: 201, Timestamp: "07/Apr/2020:05:17:15 +0200"}, perfSet)
+
+	_, ok = parser.Parse(`127.0.0.1 foo.bar.com:443 - - [07/Apr/2020:05:17:15 +0200] "-" 408 0 "-" "-" 26`)
+	assert.False(ok)
+}
+
+func TestLogFormatTimeUnits(t *testing.T) {
+	assert := assert.New(t)
+	cfg := processing.NewConfiguration()
+
+	cfg.LogFormat = `%V %t \"%r\" %>s %T`
+	parser, err := processing.NewLogLineParser(*cfg)
+	assert.NoError(err)
+	perfSet, ok := parser.Parse(`foo.bar.com [07/Apr/2020:05:17:15 +0200] "POST /api HTTP/2.0" 200 3`)
+	assert.True(ok)
+	assert.Equal("3000000", perfSet.Time)
+
+	cfg.LogFormat = `%V "%r" %s %{ms}T`
+	parser, err = processing.NewLogLineParser(*cfg)
+	assert.NoError(err)
+	perfSet, ok = parser.Parse(`foo.bar.com "GET / HTTP/1.1" 302 15`)
+	assert.True(ok)
+	assert.Equal(processing.PerfSet{Domain: "foo.bar.com", Ident: "/", Time: "15000", Code: 302}, perfSet)
+}
+
+func TestLogFormatEscapedRequest(t *testing.T) {
+	assert := assert.New(t)
+	cfg := processing.NewConfiguration()
+	cfg.LogFormat = `%V \"%r\" %>s %D`
+	parser, err := processing.NewLogLineParser(*cfg)
+	assert.NoError(err)
+
+	perfSet, ok := parser.Parse(`foo.bar.com "GET /a\"b?x=\" HTTP/1.1\\" 200 26`)
+	assert.True(ok)
+	assert.Equal(processing.PerfSet{Domain: "foo.bar.com", Ident: `/a\"b`, Time: "26", Code: 200}, perfSet)
+
+	perfSet, ok = parser.Parse(`foo.bar.com "GET /a\\ HTTP/1.1" 404 26`)
+	assert.True(ok)
+	assert.Equal(`/a\\`, perfSet.Ident)
+}
+
+func TestLogFormatErrors(t *testing.T) {
+	_, _, err := processing.CompileLogFormat(`%h %l %u %t "%r" %>s %b`)
+	assert.Error(t, err, "format without vhost and time")
+
+	_, _, err = processing.CompileLogFormat(`%v "%r" %>s %D %J`)
+	assert.Error(t, err, "unknown directive")
+
+	_, _, err = processing.CompileLogFormat(`%v "%r" %>s %{fortnights}T`)
+	assert.Error(t, err, "unknown time unit")
+}
+
+func TestLogFormatNginxPreset(t *testing.T) {
+	assert := assert.New(t)
+	cfg := processing.NewConfiguration()
+	cfg.LogFormat = "nginx_combined"
+	parser, err := processing.NewLogLineParser(*cfg)
+	assert.NoError(err)
+
+	perfSet, ok := parser.Parse(`10.0.0.1 - - [07/Apr/2020:05:17:15 +0200] "GET /foo?bar=1 HTTP/1.1" 200 612 "-" "curl/7.68.0" foo.bar.com 0.042`)
+	assert.True(ok)
+	assert.Equal(processing.PerfSet{Domain: "foo.bar.com", Ident: "/foo", Time: "42000", Code: 200, Timestamp: "07/Apr/2020:05:17:15 +0200"}, perfSet)
+}
@@ -0,0 +1,103 @@
+package processing
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// vhostAlias maps the hostnames matching a glob pattern onto a logical service name
+type vhostAlias struct {
+	pattern string
+	service string
+}
+
+// vhostNormalizer unifies the names of vhosts before accounting, i.e. "WWW.Foo.com:443" and "foo.com"
+// are accounted as the same vhost
+type vhostNormalizer struct {
+	stripPort   bool
+	lowercase   bool
+	collapseWWW bool
+	// aliases by exact hostname, patterns are evaluated afterwards in the order of the service names
+	aliases       map[string]string
+	aliasPatterns []vhostAlias
+}
+
+func newVhostNormalizer(cfg Configuration) (vhostNormalizer, error) {
+	normalizer := vhostNormalizer{
+		stripPort:   cfg.VhostStripPort,
+		lowercase:   cfg.VhostLowercase,
+		collapseWWW: cfg.VhostCollapseWWW,
+		aliases:     map[string]string{},
+	}
+	services := make([]string, 0, len(cfg.VhostAliases))
+	for service := range cfg.VhostAliases {
+		services = append(services, service)
+	}
+	sort.Strings(services)
+	for _, service := range services {
+		for _, hostname := range cfg.VhostAliases[service] {
+			// the aliases match the normalized names
+			hostname = normalizer.normalizeName(strings.TrimSpace(hostname))
+			if !strings.ContainsAny(hostname, "*?[") {
+				if other, ok := normalizer.aliases[hostname]; ok && other != service {
+					return vhostNormalizer{}, fmt.Errorf("hostname '%s' is an alias of '%s' and '%s'", hostname, other, service)
+				}
+				normalizer.aliases[hostname] = service
+				continue
+			}
+			if _, err := path.Match(hostname, ""); err != nil {
+				return vhostNormalizer{}, fmt.Errorf("invalid alias pattern '%s' of '%s': %s", hostname, service, err.Error())
+			}
+			normalizer.aliasPatterns = append(normalizer.aliasPatterns, vhostAlias{pattern: hostname, service: service})
+		}
+	}
+	return normalizer, nil
+}
+
+// stripVhostPort removes the port of "host:443" and "[::1]:443"
+func stripVhostPort(vhost string) string {
+	pos := strings.LastIndexByte(vhost, ':')
+	if pos < 0 || pos == len(vhost)-1 || strings.IndexByte(vhost[pos+1:], ']') >= 0 {
+		return vhost
+	}
+	for _, char := range vhost[pos+1:] {
+		if char < '0' || char > '9' {
+			return vhost
+		}
+	}
+	// a unbracketed ipv6 address has no port
+	if !strings.HasPrefix(vhost, "[") && strings.Count(vhost, ":") > 1 {
+		return vhost
+	}
+	return vhost[:pos]
+}
+
+// normalizeName applies the configured rules without the aliases
+func (c *vhostNormalizer) normalizeName(vhost string) string {
+	if c.stripPort {
+		vhost = stripVhostPort(vhost)
+	}
+	if c.lowercase {
+		vhost = strings.ToLower(vhost)
+	}
+	if c.collapseWWW && len(vhost) > 4 && strings.EqualFold(vhost[:4], "www.") {
+		vhost = vhost[4:]
+	}
+	return vhost
+}
+
+// normalize returns the name of the vhost used for accounting
+func (c *vhostNormalizer) normalize(vhost string) string {
+	vhost = c.normalizeName(vhost)
+	if service, ok := c.aliases[vhost]; ok {
+		return service
+	}
+	for _, alias := range c.aliasPatterns {
+		if matched, _ := path.Match(alias.pattern, vhost); matched {
+			return alias.service
+		}
+	}
+	return vhost
+}
@@ -0,0 +1,59 @@
+package processing_test
+
+import (
+	"testing"
+
+	"256bit.org/apache_logpipe/processing"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVhostNormalization(t *testing.T) {
+	assert := assert.New(t)
+	cfg := processing.NewConfiguration()
+	cfg.Exporters = []string{}
+	cfg.VhostStripPort = true
+	cfg.VhostLowercase = true
+	cfg.VhostCollapseWWW = true
+	cfg.VhostAliases = map[string][]string{
+		"shop": {"Shop.example.com", "*.shop.example.com"},
+	}
+	requestAccounting := processing.NewRequestAccounting(*cfg)
+	exporter := &recordingExporter{name: "recorder"}
+	requestAccounting.AddExporter(exporter)
+	processing.CompleteStream()
+	<-processing.CompleteChan
+
+	for _, vhost := range []string{
+		"foo.bar.com:443",
+		"Foo.Bar.com:80",
+		"WWW.foo.bar.com",
+		"[2001:db8::1]:8443",
+		"2001:db8::1",
+		"www.shop.example.com:80",
+		"cdn.shop.example.com",
+		"www",
+	} {
+		assert.True(requestAccounting.AccountRequest(vhost, "/foo", "100", 200))
+	}
+	requestAccounting.SubmitData()
+
+	stats := exporter.data[1].Stats
+	assert.Len(stats, 5)
+	assert.Equal(int64(3), stats["foo.bar.com"]["all"].Requests)
+	assert.Equal(int64(1), stats["[2001:db8::1]"]["all"].Requests, "the port of a bracketed ipv6 address is stripped")
+	assert.Equal(int64(1), stats["2001:db8::1"]["all"].Requests, "a unbracketed ipv6 address has no port")
+	assert.Equal(int64(2), stats["shop"]["all"].Requests, "aliases apply to the normalized names")
+	assert.Equal(int64(1), stats["www"]["all"].Requests)
+}
+
+func TestVhostNormalizationDisabled(t *testing.T) {
+	assert := assert.New(t)
+	cfg := processing.NewConfiguration()
+	cfg.Exporters = []string{}
+	requestAccounting := processing.NewRequestAccounting(*cfg)
+	processing.CompleteStream()
+	<-processing.CompleteChan
+
+	assert.True(requestAccounting.AccountRequest("WWW.Foo.com:443", "/foo", "100", 200))
+	assert.Contains(requestAccounting.GetJsonStats(), `"WWW.Foo.com:443"`)
+}
@@ -0,0 +1,154 @@
+package processing
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+
+	"github.com/golang/glog"
+)
+
+// LogLineParser extracts the fields needed for the accounting from a logline
+type LogLineParser interface {
+	// Parse returns the PerfSet of the logline, false if the line does not match
+	Parse(line string) (PerfSet, bool)
+}
+
+// RegexParser parses loglines by a regex with the named groups domain, uri, code, time and the optional group timestamp
+type RegexParser struct {
+	re           *regexp.Regexp
+	domainIdx    int
+	uriIdx       int
+	codeIdx      int
+	timeIdx      int
+	timestampIdx int
+	timeFactor   float64
+}
+
+// timeUnitFactors convert the supported time units to microseconds
+var timeUnitFactors = map[string]float64{
+	"s":  1000000,
+	"ms": 1000,
+	"us": 1,
+	"µs": 1,
+	"ns": 0.001,
+}
+
+// TimeUnitFactor returns the factor which converts values of the time unit to microseconds
+func TimeUnitFactor(unit string) (float64, error) {
+	factor, ok := timeUnitFactors[unit]
+	if !ok {
+		return 0, fmt.Errorf("unknown time unit '%s', supported are s, ms, us and ns", unit)
+	}
+	return factor, nil
+}
+
+// NewRegexParser creates a RegexParser, timeFactor converts the time group to microseconds
+func NewRegexParser(expr string, timeFactor float64) (*RegexParser, error) {
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	parser := &RegexParser{
+		re:           re,
+		domainIdx:    re.SubexpIndex("domain"),
+		uriIdx:       re.SubexpIndex("uri"),
+		codeIdx:      re.SubexpIndex("code"),
+		timeIdx:      re.SubexpIndex("time"),
+		timestampIdx: re.SubexpIndex("timestamp"),
+		timeFactor:   timeFactor,
+	}
+	for name, idx := range map[string]int{"domain": parser.domainIdx, "uri": parser.uriIdx, "code": parser.codeIdx, "time": parser.timeIdx} {
+		if idx < 0 {
+			return nil, fmt.Errorf("regex >>>%s<<< has no named group '%s'", expr, name)
+		}
+	}
+	return parser, nil
+}
+
+// NewLogLineParser creates the parser for the configured logline format
+func NewLogLineParser(cfg Configuration) (LogLineParser, error) {
+	timeFactor, err := TimeUnitFactor(cfg.TimeUnit)
+	if err != nil {
+		return nil, err
+	}
+	switch cfg.InputFormat {
+	case "json":
+		parser, err := NewJSONParser(cfg.JSONDomainPath, cfg.JSONURIPath, cfg.JSONCodePath, cfg.JSONTimePath, timeFactor)
+		if err != nil {
+			return nil, err
+		}
+		parser.SetTimestampPath(cfg.JSONTimestampPath)
+		return parser, nil
+	case "text":
+	default:
+		return nil, fmt.Errorf("unknown input format '%s'", cfg.InputFormat)
+	}
+	if cfg.LogFormat != "" {
+		expr, timeFactor, err := CompileLogFormat(cfg.LogFormat)
+		if err != nil {
+			return nil, err
+		}
+		glog.V(1).Infof("compiled log format >>>%s<<< to regex >>>%s<<<", cfg.LogFormat, expr)
+		parser, err := NewRegexParser(expr, timeFactor)
+		if err != nil {
+			return nil, err
+		}
+		if cfg.LogFormat == "vhost_combined_canonical" || cfg.LogFormat == LogFormatPresets["vhost_combined_canonical"] {
+			glog.V(1).Info("using the fast parser for the vhost_combined_canonical log format")
+			return NewFastParser(parser), nil
+		}
+		return parser, nil
+	}
+	parser, err := NewRegexParser(cfg.RegexLogLineString, timeFactor)
+	if err != nil {
+		return nil, err
+	}
+	// the default regex_logline parses the vhost_combined_canonical log format of the README
+	if cfg.RegexLogLineString == NewConfiguration().RegexLogLineString && timeFactor == 1 {
+		glog.V(1).Info("using the fast parser for the default regex_logline")
+		return NewDefaultRegexFastParser(parser), nil
+	}
+	return parser, nil
+}
+
+// normalizeTime converts a integer or fractional time value to integer microseconds
+func normalizeTime(value string, factor float64) (string, bool) {
+	if factor == 1 && isDigits(value) {
+		return value, true
+	}
+	time, err := strconv.ParseFloat(value, 64)
+	if err != nil || time < 0 {
+		return "", false
+	}
+	return strconv.FormatInt(int64(math.Round(time*factor)), 10), true
+}
+
+// Parse returns the PerfSet of the logline
+func (c *RegexParser) Parse(line string) (PerfSet, bool) {
+	match := c.re.FindStringSubmatch(line)
+	if len(match) == 0 {
+		return PerfSet{}, false
+	}
+	code, err := strconv.Atoi(match[c.codeIdx])
+	if err != nil {
+		glog.V(1).Infof("unable to convert code '%s' to integer", match[c.codeIdx])
+		return PerfSet{}, false
+	}
+	time, ok := normalizeTime(match[c.timeIdx], c.timeFactor)
+	if !ok {
+		glog.V(1).Infof("unable to convert time '%s' to a number", match[c.timeIdx])
+		return PerfSet{}, false
+	}
+	perfSet := PerfSet{
+		Domain: match[c.domainIdx],
+		Ident:  match[c.uriIdx],
+		Time:   time,
+		Code:   code,
+	}
+	if c.timestampIdx >= 0 {
+		perfSet.Timestamp = match[c.timestampIdx]
+	}
+	return perfSet, true
+}
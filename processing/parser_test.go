@@ -0,0 +1,62 @@
+package processing_test
+
+import (
+	"256bit.org/apache_logpipe/processing"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func init() {
+	SetupGlogForTests()
+}
+
+func TestRegexParser(t *testing.T) {
+	assert := assert.New(t)
+	parser, err := processing.NewLogLineParser(*processing.NewConfiguration())
+	assert.NoError(err)
+
+	perfSet, ok := parser.Parse(`127.0.0.1 foo.bar.com:443 - - [07/Apr/2020:05:17:15 +0200] "GET /foo?bar=1 HTTP/1.1" 301 538 "-" "Mozilla/4.0" 26`)
+	assert.True(ok)
+	assert.Equal(processing.PerfSet{Domain: "foo.bar.com:443", Ident: "/foo", Time: "26", Code: 301, Timestamp: "07/Apr/2020:05:17:15 +0200"}, perfSet)
+
+	_, ok = parser.Parse("this is not a logline")
+	assert.False(ok)
+}
+
+func TestRegexParserMissingGroup(t *testing.T) {
+	_, err := processing.NewRegexParser(`^(?P<domain>[^ ]+) (?P<uri>[^ ]+) (?P<code>\d+)$`, 1)
+	assert.Error(t, err)
+}
+
+func TestTimeUnits(t *testing.T) {
+	assert := assert.New(t)
+	expr := `^(?P<domain>[^ ]+) (?P<uri>[^ ]+) (?P<code>\d+) (?P<time>[^ ]+)$`
+	for _, testCase := range []struct {
+		unit     string
+		value    string
+		expected string
+	}{
+		{"s", "0.123", "123000"},
+		{"s", "2", "2000000"},
+		{"ms", "1.5", "1500"},
+		{"us", "26", "26"},
+		{"µs", "26.4", "26"},
+		{"ns", "123456", "123"},
+	} {
+		factor, err := processing.TimeUnitFactor(testCase.unit)
+		assert.NoError(err)
+		parser, err := processing.NewRegexParser(expr, factor)
+		assert.NoError(err)
+		perfSet, ok := parser.Parse("foo.bar.com / 200 " + testCase.value)
+		assert.True(ok)
+		assert.Equal(testCase.expected, perfSet.Time, testCase.unit+" "+testCase.value)
+	}
+
+	parser, _ := processing.NewRegexParser(expr, 1000000)
+	_, ok := parser.Parse("foo.bar.com / 200 -")
+	assert.False(ok, "nginx logs '-' if no time is available")
+
+	_, err := processing.TimeUnitFactor("fortnights")
+	assert.Error(err)
+}
@@ -0,0 +1,130 @@
+package processing
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var prometheusLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func prometheusLabels(labels ...string) string {
+	var pairs []string
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, labels[i], prometheusLabelEscaper.Replace(labels[i+1])))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// prometheusSeconds formats microseconds in seconds, the base unit of prometheus
+func prometheusSeconds(microseconds int64) string {
+	return strconv.FormatFloat(float64(microseconds)/1000000, 'g', -1, 64)
+}
+
+func writePrometheusHeader(w io.Writer, name string, metricType string, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, metricType)
+}
+
+func sortedVhosts(stats map[string]map[string]*accountingSet) []string {
+	vhosts := make([]string, 0, len(stats))
+	for vhost := range stats {
+		vhosts = append(vhosts, vhost)
+	}
+	sort.Strings(vhosts)
+	return vhosts
+}
+
+func sortedAccsets(vhostData map[string]*accountingSet) []string {
+	accsets := make([]string, 0, len(vhostData))
+	for accset := range vhostData {
+		accsets = append(accsets, accset)
+	}
+	sort.Strings(accsets)
+	return accsets
+}
+
+// WritePrometheusMetrics writes the statistics in the prometheus text exposition format
+func (c *RequestAccounting) WritePrometheusMetrics(w io.Writer) {
+	statsMutex.Lock()
+	defer statsMutex.Unlock()
+
+	classes := append([]int{}, c.classes...)
+	sort.Ints(classes)
+
+	vhosts := sortedVhosts(c.stats)
+
+	writePrometheusHeader(w, "apache_logpipe_errors_total", "counter", "Number of requests with a error http code class")
+	for _, vhost := range vhosts {
+		for _, accset := range sortedAccsets(c.stats[vhost]) {
+			fmt.Fprintf(w, "apache_logpipe_errors_total%s %d\n", prometheusLabels("vhost", vhost, "accset", accset), c.stats[vhost][accset].Errors)
+		}
+	}
+
+	// the response time classes are lower bounds of integer microseconds, the requests of a class are faster
+	// than the next class, therefore the inclusive upper bound of a bucket is the next class minus one microsecond
+	writePrometheusHeader(w, "apache_logpipe_response_time_seconds", "histogram", "Response times of accounted requests in seconds")
+	for _, vhost := range vhosts {
+		for _, accset := range sortedAccsets(c.stats[vhost]) {
+			accsetData := c.stats[vhost][accset]
+			var cumulative int64
+			for i, class := range classes {
+				cumulative += accsetData.Classes[class]
+				if i+1 < len(classes) && classes[i+1] != class {
+					fmt.Fprintf(w, "apache_logpipe_response_time_seconds_bucket%s %d\n",
+						prometheusLabels("vhost", vhost, "accset", accset, "le", prometheusSeconds(int64(classes[i+1]-1))), cumulative)
+				}
+			}
+			fmt.Fprintf(w, "apache_logpipe_response_time_seconds_bucket%s %d\n", prometheusLabels("vhost", vhost, "accset", accset, "le", "+Inf"), accsetData.Count)
+			fmt.Fprintf(w, "apache_logpipe_response_time_seconds_sum%s %s\n", prometheusLabels("vhost", vhost, "accset", accset), prometheusSeconds(accsetData.Sum))
+			fmt.Fprintf(w, "apache_logpipe_response_time_seconds_count%s %d\n", prometheusLabels("vhost", vhost, "accset", accset), accsetData.Count)
+		}
+	}
+
+	writePrometheusHeader(w, "apache_logpipe_responses_total", "counter", "Number of accounted requests by http status code")
+	for _, vhost := range vhosts {
+		for _, accset := range sortedAccsets(c.stats[vhost]) {
+			accsetData := c.stats[vhost][accset]
+			var codes []int
+			for code := range accsetData.Codes {
+				codes = append(codes, code)
+			}
+			sort.Ints(codes)
+			for _, code := range codes {
+				fmt.Fprintf(w, "apache_logpipe_responses_total%s %d\n",
+					prometheusLabels("vhost", vhost, "accset", accset, "code", fmt.Sprintf("%d", code)), accsetData.Codes[code])
+			}
+		}
+	}
+
+	writePrometheusHeader(w, "apache_logpipe_last_seen_timestamp_seconds", "gauge", "Time of the last accounted request")
+	for _, vhost := range vhosts {
+		for _, accset := range sortedAccsets(c.stats[vhost]) {
+			fmt.Fprintf(w, "apache_logpipe_last_seen_timestamp_seconds%s %d\n", prometheusLabels("vhost", vhost, "accset", accset), c.stats[vhost][accset].LastSeen.Unix())
+		}
+	}
+
+	writePrometheusHeader(w, "apache_logpipe_dropped_requests_total", "counter", "Number of requests dropped by the vhost denylist")
+	fmt.Fprintf(w, "apache_logpipe_dropped_requests_total %d\n", c.GetDroppedRequests())
+
+	writePrometheusHeader(w, "apache_logpipe_folded_requests_total", "counter", "Number of requests accounted in the overflow vhost or the other accounting set")
+	fmt.Fprintf(w, "apache_logpipe_folded_requests_total %d\n", c.GetFoldedRequests())
+
+	writePrometheusHeader(w, "apache_logpipe_failed_zabbix_sends_total", "counter", "Number of failed zabbix data deliveries")
+	fmt.Fprintf(w, "apache_logpipe_failed_zabbix_sends_total %d\n", c.GetFailedZabbixSends())
+
+	writePrometheusHeader(w, "apache_logpipe_skipped_zabbix_sends_total", "counter", "Number of zabbix data deliveries spooled without a attempt during the retry backoff")
+	fmt.Fprintf(w, "apache_logpipe_skipped_zabbix_sends_total %d\n", c.GetSkippedZabbixSends())
+
+	spoolStatus := c.GetZabbixSpoolStatus()
+	writePrometheusHeader(w, "apache_logpipe_zabbix_spool_packets", "gauge", "Number of zabbix packets waiting for delivery")
+	fmt.Fprintf(w, "apache_logpipe_zabbix_spool_packets %d\n", spoolStatus.Packets)
+
+	writePrometheusHeader(w, "apache_logpipe_zabbix_spool_age_seconds", "gauge", "Age of the oldest zabbix packet waiting for delivery")
+	fmt.Fprintf(w, "apache_logpipe_zabbix_spool_age_seconds %f\n", spoolStatus.Age.Seconds())
+
+	writePrometheusHeader(w, "apache_logpipe_zabbix_spool_dropped_packets_total", "counter", "Number of zabbix packets dropped because the spool was full")
+	fmt.Fprintf(w, "apache_logpipe_zabbix_spool_dropped_packets_total %d\n", spoolStatus.Dropped)
+}
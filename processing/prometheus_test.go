@@ -0,0 +1,50 @@
+package processing_test
+
+import (
+	"256bit.org/apache_logpipe/processing"
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func init() {
+	SetupGlogForTests()
+}
+
+func TestPrometheusMetrics(t *testing.T) {
+	assert := assert.New(t)
+	cfg := processing.NewConfiguration()
+	cfg.ResponstimeClasses = []int{0, 1000, 5000}
+	requestAccounting := processing.NewRequestAccounting(*cfg)
+	requestAccounting.DisableZabbixSender(true)
+
+	for _, perfSet := range []processing.PerfSet{
+		{Domain: "dom1", Ident: "/foo", Time: "10", Code: 200},
+		{Domain: "dom1", Ident: "/foo", Time: "2000", Code: 200},
+		{Domain: "dom1", Ident: "/foo", Time: "9000", Code: 302},
+		{Domain: `dom"2`, Ident: "/foo", Time: "1000", Code: 200},
+	} {
+		processing.PerfSetChan <- perfSet
+	}
+	processing.CompleteStream()
+	<-processing.CompleteChan
+
+	var buf bytes.Buffer
+	requestAccounting.WritePrometheusMetrics(&buf)
+	metrics := buf.String()
+
+	assert.Contains(metrics, "# TYPE apache_logpipe_response_time_seconds histogram\n")
+	assert.NotContains(metrics, "apache_logpipe_requests_total", "the number of requests is provided by the histogram and the responses")
+	assert.Contains(metrics, `apache_logpipe_response_time_seconds_bucket{vhost="dom1",accset="all",le="0.000999"} 1`+"\n")
+	assert.Contains(metrics, `apache_logpipe_response_time_seconds_bucket{vhost="dom1",accset="all",le="0.004999"} 2`+"\n")
+	assert.Contains(metrics, `apache_logpipe_response_time_seconds_bucket{vhost="dom1",accset="all",le="+Inf"} 3`+"\n")
+	assert.Contains(metrics, `apache_logpipe_response_time_seconds_sum{vhost="dom1",accset="all"} 0.01101`+"\n")
+	assert.Contains(metrics, `apache_logpipe_response_time_seconds_count{vhost="dom1",accset="all"} 3`+"\n")
+	assert.Contains(metrics, `apache_logpipe_responses_total{vhost="dom1",accset="all",code="302"} 1`+"\n")
+	assert.Contains(metrics, `apache_logpipe_response_time_seconds_bucket{vhost="dom\"2",accset="all",le="0.000999"} 0`+"\n")
+	assert.Contains(metrics, `apache_logpipe_response_time_seconds_bucket{vhost="dom\"2",accset="all",le="0.004999"} 1`+"\n", "the boundary value belongs to its class")
+	assert.Contains(metrics, "apache_logpipe_zabbix_spool_packets 0\n")
+	assert.Contains(metrics, "apache_logpipe_skipped_zabbix_sends_total 0\n")
+	assert.Regexp(`apache_logpipe_last_seen_timestamp_seconds\{vhost="dom1",accset="all"\} \d+\n`, metrics)
+}
@@ -0,0 +1,160 @@
+package processing
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// regex fragments for the strftime verbs which are used in filename patterns
+var strftimeVerbRegex = map[byte]string{
+	'Y': `\d{4}`,
+	'y': `\d{2}`,
+	'C': `\d{2}`,
+	'm': `\d{2}`,
+	'd': `\d{2}`,
+	'e': `[ \d]\d`,
+	'H': `\d{2}`,
+	'I': `\d{2}`,
+	'M': `\d{2}`,
+	'S': `\d{2}`,
+	'j': `\d{3}`,
+	'U': `\d{2}`,
+	'V': `\d{2}`,
+	'W': `\d{2}`,
+	'u': `\d`,
+	'w': `\d`,
+	'a': `[A-Za-z]+`,
+	'A': `[A-Za-z]+`,
+	'b': `[A-Za-z]+`,
+	'B': `[A-Za-z]+`,
+	'h': `[A-Za-z]+`,
+	'p': `[A-Za-z]+`,
+	'F': `\d{4}-\d{2}-\d{2}`,
+	'D': `\d{2}/\d{2}/\d{2}`,
+	'T': `\d{2}:\d{2}:\d{2}`,
+	'R': `\d{2}:\d{2}`,
+	'%': `%`,
+}
+
+// filenamePatternRegex converts the basename of a strftime pattern to a regex which matches
+// all logfiles created by the pattern, including the compressed variants
+func filenamePatternRegex(pattern string) *regexp.Regexp {
+	var re strings.Builder
+	re.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		if pattern[i] == '%' && i+1 < len(pattern) {
+			i++
+			if verbRegex, ok := strftimeVerbRegex[pattern[i]]; ok {
+				re.WriteString(verbRegex)
+			} else {
+				re.WriteString(".+?")
+			}
+			continue
+		}
+		re.WriteString(regexp.QuoteMeta(string(pattern[i])))
+	}
+	re.WriteString(`(\.gz|\.zst)?$`)
+	return regexp.MustCompile(re.String())
+}
+
+// SetRetention configures the removal of old logfiles, a zero value disables the particular limit
+func (c *LogSink) SetRetention(maxAge time.Duration, maxFiles int, maxTotalBytes int64) {
+	mu.Lock()
+	defer mu.Unlock()
+	c.RetentionMaxAge = maxAge
+	c.RetentionMaxFiles = maxFiles
+	c.RetentionMaxTotalBytes = maxTotalBytes
+}
+
+func (c *LogSink) retentionEnabled() bool {
+	return c.RetentionMaxAge > 0 || c.RetentionMaxFiles > 0 || c.RetentionMaxTotalBytes > 0
+}
+
+type logfileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+// findLogfiles returns the logfiles created by the filename pattern, newest first
+func (c *LogSink) findLogfiles() []logfileInfo {
+	dir, base := filepath.Split(c.FilenamePattern)
+	if strings.Contains(dir, "%") {
+		glog.Warningf("retention does not support timestamps in the directory part of %s", c.FilenamePattern)
+		return nil
+	}
+	if dir == "" {
+		dir = "."
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		glog.Errorf("unable to read logfile directory %s: %s", dir, err.Error())
+		return nil
+	}
+	re := filenamePatternRegex(base)
+	var logfiles []logfileInfo
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || !re.MatchString(entry.Name()) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		logfiles = append(logfiles, logfileInfo{
+			name:    filepath.Join(dir, entry.Name()),
+			size:    info.Size(),
+			modTime: info.ModTime(),
+		})
+	}
+	sort.Slice(logfiles, func(i, j int) bool {
+		return logfiles[i].modTime.After(logfiles[j].modTime)
+	})
+	return logfiles
+}
+
+// pruneLogfiles removes the oldest logfiles exceeding the retention limits, the current logfile is never removed
+func (c *LogSink) pruneLogfiles(currentFilename string) {
+	if !c.retentionEnabled() {
+		return
+	}
+	c.retentionMutex.Lock()
+	defer c.retentionMutex.Unlock()
+
+	logfiles := c.findLogfiles()
+	var files int
+	var totalBytes int64
+	for _, logfile := range logfiles {
+		if filepath.Clean(logfile.name) == filepath.Clean(currentFilename) {
+			files++
+			totalBytes += logfile.size
+		}
+	}
+
+	now := time.Now()
+	limitExceeded := false
+	for _, logfile := range logfiles {
+		if filepath.Clean(logfile.name) == filepath.Clean(currentFilename) {
+			continue
+		}
+		limitExceeded = limitExceeded || (c.RetentionMaxFiles > 0 && files >= c.RetentionMaxFiles)
+		limitExceeded = limitExceeded || (c.RetentionMaxTotalBytes > 0 && totalBytes+logfile.size > c.RetentionMaxTotalBytes)
+		expired := c.RetentionMaxAge > 0 && now.Sub(logfile.modTime) > c.RetentionMaxAge
+		if !limitExceeded && !expired {
+			files++
+			totalBytes += logfile.size
+			continue
+		}
+		glog.Infof("removing logfile %s, last modified %s", logfile.name, logfile.modTime)
+		err := os.Remove(logfile.name)
+		if err != nil {
+			glog.Errorf("unable to remove logfile %s: %s", logfile.name, err.Error())
+		}
+	}
+}
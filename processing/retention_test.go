@@ -0,0 +1,85 @@
+package processing_test
+
+import (
+	"256bit.org/apache_logpipe/processing"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func init() {
+	SetupGlogForTests()
+}
+
+func createOldLogfile(t *testing.T, filename string, size int, age time.Duration) {
+	err := os.WriteFile(filename, make([]byte, size), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Now().Add(-age)
+	err = os.Chtimes(filename, modTime, modTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRetentionMaxAge(t *testing.T) {
+	processing.DestroyLogSinkSingleton()
+	assert := assert.New(t)
+	testDir := SetupLogfileTestDir()
+	defer RemoveTestDir(testDir)
+
+	createOldLogfile(t, testDir+"/access.log_2020-04-01.gz", 10, 72*time.Hour)
+	createOldLogfile(t, testDir+"/access.log_2020-04-02.zst", 10, 48*time.Hour)
+	createOldLogfile(t, testDir+"/access.log_2020-04-03", 10, 1*time.Hour)
+	createOldLogfile(t, testDir+"/other.log_2020-04-01", 10, 72*time.Hour)
+
+	ls := processing.NewLogSink(testDir+"/access.log_%Y-%m-%d", "")
+	ls.SetRetention(36*time.Hour, 0, 0)
+	ls.SubmitLogLine("TEST")
+	ls.CommitLogStream()
+	ls.TerminateLogStream()
+
+	assert.NoFileExists(testDir + "/access.log_2020-04-01.gz")
+	assert.NoFileExists(testDir + "/access.log_2020-04-02.zst")
+	assert.FileExists(testDir + "/access.log_2020-04-03")
+	assert.FileExists(testDir+"/other.log_2020-04-01", "files not created by the pattern are kept")
+}
+
+func TestRetentionMaxFilesAndBytes(t *testing.T) {
+	processing.DestroyLogSinkSingleton()
+	assert := assert.New(t)
+	testDir := SetupLogfileTestDir()
+	defer RemoveTestDir(testDir)
+
+	for day := 1; day <= 5; day++ {
+		createOldLogfile(t, fmt.Sprintf("%s/access.log_2020-04-0%d", testDir, day), 100, time.Duration(6-day)*time.Hour)
+	}
+
+	ls := processing.NewLogSink(testDir+"/access.log_%Y-%m-%d", "")
+	ls.SetRetention(0, 4, 0)
+	ls.SubmitLogLine("TEST")
+	ls.CommitLogStream()
+	assert.FileExists(ls.CurrentFileName)
+	ls.CloseLogStream()
+	ls.TerminateLogStream()
+
+	assert.NoFileExists(testDir + "/access.log_2020-04-01")
+	assert.NoFileExists(testDir + "/access.log_2020-04-02")
+	assert.FileExists(testDir + "/access.log_2020-04-03")
+	assert.FileExists(testDir + "/access.log_2020-04-05")
+
+	processing.DestroyLogSinkSingleton()
+	ls = processing.NewLogSink(testDir+"/access.log_%Y-%m-%d", "")
+	ls.SetRetention(0, 0, 250)
+	ls.SubmitLogLine("TEST")
+	ls.CommitLogStream()
+	ls.TerminateLogStream()
+
+	assert.NoFileExists(testDir + "/access.log_2020-04-03")
+	assert.FileExists(testDir + "/access.log_2020-04-04")
+	assert.FileExists(testDir + "/access.log_2020-04-05")
+}
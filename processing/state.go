@@ -0,0 +1,153 @@
+package processing
+
+import (
+	"encoding/json"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const accountingStateVersion = 1
+
+// accountingState contains the lifetime counters which survive restarts of the logger,
+// the statistics of the sending intervals and the percentiles start from scratch
+type accountingState struct {
+	Version int                                       `json:"version"`
+	Time    time.Time                                 `json:"time"`
+	Stats   map[string]map[string]*accountingSetState `json:"stats"`
+	Names   map[string]map[string][]string            `json:"mapping_names"`
+	Dropped int64                                     `json:"dropped"`
+	Folded  int64                                     `json:"folded"`
+}
+
+type accountingSetState struct {
+	Count       int64            `json:"count"`
+	Sum         int64            `json:"sum"`
+	Classes     map[int]int64    `json:"classes"`
+	Requests    int64            `json:"requests"`
+	Errors      int64            `json:"errors"`
+	Codes       map[int]int64    `json:"codes"`
+	CodeClasses map[string]int64 `json:"code_classes"`
+	LastSeen    time.Time        `json:"last_seen"`
+}
+
+// saveState writes the lifetime counters to the state file
+func (c *RequestAccounting) saveState() {
+	if c.stateFile == "" {
+		return
+	}
+	statsMutex.Lock()
+	state := accountingState{
+		Version: accountingStateVersion,
+		Time:    c.now(),
+		Stats:   map[string]map[string]*accountingSetState{},
+		Names:   map[string]map[string][]string{},
+		Dropped: c.GetDroppedRequests(),
+		Folded:  c.GetFoldedRequests(),
+	}
+	for vhost, vhostData := range c.stats {
+		state.Stats[vhost] = map[string]*accountingSetState{}
+		for accset, accsetData := range vhostData {
+			state.Stats[vhost][accset] = &accountingSetState{
+				Count:       accsetData.Count,
+				Sum:         accsetData.Sum,
+				Classes:     accsetData.Classes,
+				Requests:    accsetData.Requests,
+				Errors:      accsetData.Errors,
+				Codes:       accsetData.Codes,
+				CodeClasses: accsetData.CodeClasses,
+				LastSeen:    accsetData.LastSeen,
+			}
+		}
+	}
+	for vhost, mappings := range c.mappingNames {
+		state.Names[vhost] = map[string][]string{}
+		for mapping, names := range mappings {
+			for name := range names {
+				state.Names[vhost][mapping] = append(state.Names[vhost][mapping], name)
+			}
+		}
+	}
+	data, err := json.Marshal(state)
+	statsMutex.Unlock()
+	if err != nil {
+		glog.Fatalf("unable to marshal accounting state: %s", err.Error())
+	}
+	if err = WriteFileAtomic(c.stateFile, data); err != nil {
+		glog.Errorf("unable to write accounting state file %s: %s", c.stateFile, err.Error())
+		return
+	}
+	glog.V(1).Infof("wrote accounting state file %s", c.stateFile)
+}
+
+// loadState restores the lifetime counters of the state file, a missing or invalid file starts with empty statistics
+func (c *RequestAccounting) loadState() {
+	if c.stateFile == "" {
+		return
+	}
+	data, err := os.ReadFile(c.stateFile)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		glog.Errorf("unable to read accounting state file %s: %s", c.stateFile, err.Error())
+		return
+	}
+	var state accountingState
+	if err = json.Unmarshal(data, &state); err != nil || state.Version != accountingStateVersion || state.Stats == nil {
+		glog.Errorf("ignoring invalid accounting state file %s", c.stateFile)
+		return
+	}
+
+	statsMutex.Lock()
+	defer statsMutex.Unlock()
+	for vhost, vhostData := range state.Stats {
+		for accset, accsetState := range vhostData {
+			if accsetState == nil {
+				continue
+			}
+			if c.stats[vhost] == nil {
+				c.stats[vhost] = map[string]*accountingSet{}
+			}
+			accsetData := c.newAccountingSet()
+			accsetData.Count = accsetState.Count
+			accsetData.Sum = accsetState.Sum
+			accsetData.Requests = accsetState.Requests
+			accsetData.Errors = accsetState.Errors
+			accsetData.LastSeen = accsetState.LastSeen
+			// classes which are no longer configured are discarded
+			for class := range accsetData.Classes {
+				accsetData.Classes[class] = accsetState.Classes[class]
+			}
+			for code, count := range accsetState.Codes {
+				accsetData.Codes[code] = count
+			}
+			for codeClass, count := range accsetState.CodeClasses {
+				accsetData.CodeClasses[codeClass] = count
+			}
+			c.stats[vhost][accset] = accsetData
+		}
+	}
+	for vhost, mappings := range state.Names {
+		for mapping, names := range mappings {
+			if _, ok := c.mappingTemplates[mapping]; !ok {
+				continue
+			}
+			if c.mappingNames[vhost] == nil {
+				c.mappingNames[vhost] = map[string]map[string]bool{}
+			}
+			if c.mappingNames[vhost][mapping] == nil {
+				c.mappingNames[vhost][mapping] = map[string]bool{}
+			}
+			for _, name := range names {
+				c.mappingNames[vhost][mapping][name] = true
+			}
+		}
+	}
+	atomic.StoreInt64(&c.cardinality.counters.dropped, state.Dropped)
+	atomic.StoreInt64(&c.cardinality.counters.folded, state.Folded)
+	glog.Infof("restored the statistics of %d vhosts from accounting state file %s written at %s",
+		len(state.Stats), c.stateFile, state.Time.Format(time.RFC3339))
+}
@@ -0,0 +1,71 @@
+package processing_test
+
+import (
+	"os"
+	"regexp"
+	"testing"
+
+	"256bit.org/apache_logpipe/processing"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAccountingStatePersistence(t *testing.T) {
+	assert := assert.New(t)
+	testDir := SetupLogfileTestDir()
+	defer RemoveTestDir(testDir)
+
+	cfg := processing.NewConfiguration()
+	cfg.Exporters = []string{}
+	cfg.AccountingStateFile = testDir + "/accounting.state"
+	cfg.ResponstimeClasses = []int{0, 1000}
+	cfg.RequestMappings = map[string]*regexp.Regexp{"path": regexp.MustCompile(`^/(\w+)`)}
+	cfg.RequestMappingTemplates = map[string]string{"path": "$1"}
+	cfg.MaxMappingNames = 1
+	cfg.VhostDenylist = []string{"denied"}
+	processing.NewRequestAccounting(*cfg)
+
+	processing.PerfSetChan <- processing.PerfSet{Domain: "dom1", Ident: "/foo", Time: "500", Code: 200}
+	processing.PerfSetChan <- processing.PerfSet{Domain: "dom1", Ident: "/foo", Time: "1500", Code: 503}
+	processing.PerfSetChan <- processing.PerfSet{Domain: "denied", Ident: "/foo", Time: "1500", Code: 200}
+	processing.CompleteStream()
+	<-processing.CompleteChan
+	assert.FileExists(cfg.AccountingStateFile, "the state is written on completion")
+
+	requestAccounting := processing.NewRequestAccounting(*cfg)
+	exporter := &recordingExporter{name: "recorder"}
+	requestAccounting.AddExporter(exporter)
+	processing.CompleteStream()
+	<-processing.CompleteChan
+
+	requestAccounting.AccountRequest("dom1", "/foo", "700", 200)
+	requestAccounting.AccountRequest("dom1", "/bar", "700", 200)
+	requestAccounting.SubmitData()
+
+	stats := exporter.data[1].Stats
+	assert.Equal(int64(3), stats["dom1"]["foo"].Requests, "the lifetime counters continue")
+	assert.Equal(int64(1), stats["dom1"]["foo"].Errors)
+	assert.Equal(int64(1200), stats["dom1"]["foo"].Sum)
+	assert.Equal(int64(2), stats["dom1"]["foo"].Classes[0])
+	assert.Equal(int64(1), stats["dom1"]["foo"].Codes[503])
+	assert.Equal(int64(1), stats["dom1"]["foo"].Interval.Requests, "the interval starts from scratch")
+	assert.Equal(int64(1), stats["dom1"][processing.OtherAccset].Requests, "the names of the mapping templates are restored")
+	assert.Equal(int64(1), requestAccounting.GetDroppedRequests())
+}
+
+func TestAccountingStateInvalidVersion(t *testing.T) {
+	assert := assert.New(t)
+	testDir := SetupLogfileTestDir()
+	defer RemoveTestDir(testDir)
+
+	cfg := processing.NewConfiguration()
+	cfg.Exporters = []string{}
+	cfg.AccountingStateFile = testDir + "/accounting.state"
+	err := os.WriteFile(cfg.AccountingStateFile, []byte(`{"version":0,"stats":{"dom1":{"all":{"requests":5}}}}`), 0644)
+	assert.NoError(err)
+
+	requestAccounting := processing.NewRequestAccounting(*cfg)
+	processing.CompleteStream()
+	<-processing.CompleteChan
+	vhosts, _ := requestAccounting.GetStatistics()
+	assert.Equal(int64(0), vhosts, "a state file of a unknown version is ignored")
+}
@@ -0,0 +1,177 @@
+package processing
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+// maximum size of a udp packet, fits into a ethernet frame
+const statsdMaxPacketSize = 1432
+
+var statsdInvalidChars = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+
+// dogstatsdTagEscaper replaces the delimiters of the tags, the metrics and the lines in tag values
+var dogstatsdTagEscaper = strings.NewReplacer(",", "_", "|", "_", "#", "_", "\n", "_")
+
+// StatsdExporter sends the statistics over udp in the statsd or dogstatsd format
+type StatsdExporter struct {
+	address   string
+	prefix    string
+	dogstatsd bool
+	timings   bool
+	tags      []string
+	conn      net.Conn
+	buffer    bytes.Buffer
+	mutex     sync.Mutex
+}
+
+// NewStatsdExporter creates a StatsdExporter instance
+func NewStatsdExporter(cfg Configuration) (*StatsdExporter, error) {
+	exporter := &StatsdExporter{
+		address: cfg.StatsdServer,
+		prefix:  cfg.StatsdPrefix,
+		tags:    cfg.StatsdTags,
+	}
+	switch cfg.StatsdFlavor {
+	case "statsd":
+	case "dogstatsd":
+		exporter.dogstatsd = true
+	default:
+		return nil, fmt.Errorf("unknown statsd flavor '%s'", cfg.StatsdFlavor)
+	}
+	switch cfg.StatsdMode {
+	case "aggregated":
+	case "timing":
+		exporter.timings = true
+	default:
+		return nil, fmt.Errorf("unknown statsd mode '%s'", cfg.StatsdMode)
+	}
+	if !exporter.dogstatsd && len(exporter.tags) > 0 {
+		glog.Warningf("statsd tags %s are only supported by the dogstatsd flavor", strings.Join(exporter.tags, ","))
+	}
+	return exporter, nil
+}
+
+// Name returns the name of the exporter
+func (c *StatsdExporter) Name() string {
+	return "statsd"
+}
+
+// SendDiscovery is not needed for statsd
+func (c *StatsdExporter) SendDiscovery(snapshot *StatsSnapshot) {
+}
+
+// metricLine formats a metric, statsd encodes vhost, accset and labels into the name, dogstatsd uses tags
+func (c *StatsdExporter) metricLine(vhost string, accset string, name string, value string, metricType string, labels ...string) string {
+	if c.dogstatsd {
+		tags := []string{"vhost:" + dogstatsdTagEscaper.Replace(vhost), "accset:" + dogstatsdTagEscaper.Replace(accset)}
+		for i := 0; i+1 < len(labels); i += 2 {
+			tags = append(tags, labels[i]+":"+dogstatsdTagEscaper.Replace(labels[i+1]))
+		}
+		tags = append(tags, c.tags...)
+		return fmt.Sprintf("%s.%s:%s|%s|#%s", c.prefix, name, value, metricType, strings.Join(tags, ","))
+	}
+	parts := []string{c.prefix, statsdInvalidChars.ReplaceAllString(vhost, "_"), statsdInvalidChars.ReplaceAllString(accset, "_"), name}
+	for i := 0; i+1 < len(labels); i += 2 {
+		parts = append(parts, labels[i]+"_"+statsdInvalidChars.ReplaceAllString(labels[i+1], "_"))
+	}
+	return fmt.Sprintf("%s:%s|%s", strings.Join(parts, "."), value, metricType)
+}
+
+// write adds a metric to the current packet, the packet is sent if it would exceed the maximum size
+func (c *StatsdExporter) write(line string) {
+	if c.buffer.Len() > 0 && c.buffer.Len()+1+len(line) > statsdMaxPacketSize {
+		c.flush()
+	}
+	if c.buffer.Len() > 0 {
+		c.buffer.WriteByte('\n')
+	}
+	c.buffer.WriteString(line)
+}
+
+func (c *StatsdExporter) flush() {
+	if c.buffer.Len() == 0 {
+		return
+	}
+	defer c.buffer.Reset()
+	if c.conn == nil {
+		conn, err := net.Dial("udp", c.address)
+		if err != nil {
+			glog.Errorf("unable to connect to statsd server %s: %s", c.address, err.Error())
+			return
+		}
+		c.conn = conn
+	}
+	_, err := c.conn.Write(c.buffer.Bytes())
+	if err != nil {
+		glog.Errorf("unable to send statsd metrics to %s: %s", c.address, err.Error())
+	}
+}
+
+// ObserveRequest sends the timing of a single request if the exporter runs in timing mode
+func (c *StatsdExporter) ObserveRequest(vhost string, accset string, responsetime int, code int, timed bool) {
+	if !c.timings {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if timed {
+		c.write(c.metricLine(vhost, accset, "response_time", fmt.Sprintf("%.3f", float64(responsetime)/1000), "ms"))
+	}
+	c.write(c.metricLine(vhost, accset, "responses", "1", "c", "code", fmt.Sprintf("%d", code)))
+}
+
+// SendData sends the counters of the sending interval, in timing mode the pending timings are flushed
+func (c *StatsdExporter) SendData(snapshot *StatsSnapshot) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.timings {
+		c.flush()
+		return
+	}
+	for _, vhost := range sortedVhosts(snapshot.Stats) {
+		for _, accset := range sortedAccsets(snapshot.Stats[vhost]) {
+			// the statistics of the interval are sent, the lifetime counters may contain restored counters of previous runs
+			interval := snapshot.Stats[vhost][accset].Interval
+			if interval == nil {
+				continue
+			}
+			c.write(c.metricLine(vhost, accset, "requests", fmt.Sprintf("%d", interval.Requests), "c"))
+			c.write(c.metricLine(vhost, accset, "errors", fmt.Sprintf("%d", interval.Errors), "c"))
+			c.write(c.metricLine(vhost, accset, "response_time_sum", fmt.Sprintf("%d", interval.Sum), "c"))
+			if interval.Count > 0 {
+				c.write(c.metricLine(vhost, accset, "response_time_avg", fmt.Sprintf("%.3f", interval.Average), "g"))
+			}
+
+			var classes []int
+			for class := range interval.Classes {
+				classes = append(classes, class)
+			}
+			sort.Ints(classes)
+			for _, class := range classes {
+				if count := interval.Classes[class]; count > 0 {
+					c.write(c.metricLine(vhost, accset, "requests_by_class", fmt.Sprintf("%d", count), "c", "class", fmt.Sprintf("%d", class)))
+				}
+			}
+
+			var codes []int
+			for code := range interval.Codes {
+				codes = append(codes, code)
+			}
+			sort.Ints(codes)
+			for _, code := range codes {
+				if count := interval.Codes[code]; count > 0 {
+					c.write(c.metricLine(vhost, accset, "responses", fmt.Sprintf("%d", count), "c", "code", fmt.Sprintf("%d", code)))
+				}
+			}
+		}
+	}
+	c.flush()
+}
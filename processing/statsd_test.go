@@ -0,0 +1,108 @@
+package processing_test
+
+import (
+	"256bit.org/apache_logpipe/processing"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func init() {
+	SetupGlogForTests()
+}
+
+// receiveStatsdLines collects the metric lines received until no more packets arrive
+func receiveStatsdLines(t *testing.T, conn net.PacketConn) []string {
+	var lines []string
+	buf := make([]byte, 65536)
+	for {
+		conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return lines
+		}
+		lines = append(lines, strings.Split(string(buf[:n]), "\n")...)
+	}
+}
+
+func runStatsdAccounting(t *testing.T, cfg *processing.Configuration) []string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	cfg.Exporters = []string{"statsd"}
+	cfg.StatsdServer = conn.LocalAddr().String()
+	cfg.ResponstimeClasses = []int{0, 1000}
+	processing.NewRequestAccounting(*cfg)
+
+	processing.PerfSetChan <- processing.PerfSet{Domain: "foo.bar.com:443", Ident: "/foo", Time: "500", Code: 200}
+	processing.PerfSetChan <- processing.PerfSet{Domain: "foo.bar.com:443", Ident: "/foo", Time: "1500", Code: 404}
+	processing.CompleteStream()
+	<-processing.CompleteChan
+
+	return receiveStatsdLines(t, conn)
+}
+
+func TestStatsdAggregated(t *testing.T) {
+	lines := runStatsdAccounting(t, processing.NewConfiguration())
+
+	assert.Contains(t, lines, "apache_logpipe.foo_bar_com_443.all.requests:2|c")
+	assert.Contains(t, lines, "apache_logpipe.foo_bar_com_443.all.errors:0|c")
+	assert.Contains(t, lines, "apache_logpipe.foo_bar_com_443.all.response_time_sum:500|c", "4xx are not included in the latency")
+	assert.Contains(t, lines, "apache_logpipe.foo_bar_com_443.all.response_time_avg:500.000|g")
+	assert.Contains(t, lines, "apache_logpipe.foo_bar_com_443.all.requests_by_class.class_0:1|c")
+	assert.NotContains(t, lines, "apache_logpipe.foo_bar_com_443.all.requests_by_class.class_1000:1|c")
+	assert.Contains(t, lines, "apache_logpipe.foo_bar_com_443.all.responses.code_404:1|c")
+}
+
+func TestStatsdAggregatedRestoredState(t *testing.T) {
+	testDir := SetupLogfileTestDir()
+	defer RemoveTestDir(testDir)
+	cfg := processing.NewConfiguration()
+	cfg.AccountingStateFile = testDir + "/state.json"
+	runStatsdAccounting(t, cfg)
+	lines := runStatsdAccounting(t, cfg)
+
+	assert.Contains(t, lines, "apache_logpipe.foo_bar_com_443.all.requests:2|c", "the restored counters are not sent again")
+	assert.Contains(t, lines, "apache_logpipe.foo_bar_com_443.all.response_time_sum:500|c")
+}
+
+func TestDogStatsdTimings(t *testing.T) {
+	cfg := processing.NewConfiguration()
+	cfg.StatsdFlavor = "dogstatsd"
+	cfg.StatsdMode = "timing"
+	cfg.StatsdTags = []string{"env:test"}
+	lines := runStatsdAccounting(t, cfg)
+
+	assert.Equal(t, []string{
+		"apache_logpipe.response_time:0.500|ms|#vhost:foo.bar.com:443,accset:all,env:test",
+		"apache_logpipe.responses:1|c|#vhost:foo.bar.com:443,accset:all,code:200,env:test",
+		"apache_logpipe.responses:1|c|#vhost:foo.bar.com:443,accset:all,code:404,env:test",
+	}, lines)
+}
+
+func TestDogStatsdTagValues(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	cfg := processing.NewConfiguration()
+	cfg.Exporters = []string{"statsd"}
+	cfg.StatsdServer = conn.LocalAddr().String()
+	cfg.StatsdFlavor = "dogstatsd"
+	cfg.StatsdMode = "timing"
+	processing.NewRequestAccounting(*cfg)
+
+	processing.PerfSetChan <- processing.PerfSet{Domain: "foo,bar|baz#1", Ident: "/foo", Time: "500", Code: 200}
+	processing.CompleteStream()
+	<-processing.CompleteChan
+
+	assert.Contains(t, receiveStatsdLines(t, conn), "apache_logpipe.response_time:0.500|ms|#vhost:foo_bar_baz_1,accset:all", "the delimiters of the tags are replaced")
+}
@@ -12,6 +12,7 @@ type WebInterface struct {
 	ListenInterface string
 	User            string
 	Password        string
+	MetricsAuth     bool
 	data            RequestAccounting
 }
 
@@ -22,6 +23,7 @@ func NewWebInterface(cfg Configuration, data RequestAccounting) *WebInterface {
 		ListenInterface: cfg.WebInterfaceListen,
 		User:            cfg.WebInterfaceUser,
 		Password:        cfg.WebInterfacePassword,
+		MetricsAuth:     cfg.WebInterfaceMetricsAuth,
 		data:            data,
 	}
 	return &WebInterfaceInst
@@ -31,12 +33,23 @@ func (c *WebInterface) getStatus(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, c.data.GetJsonStats())
 }
 
+func (c *WebInterface) getMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	c.data.WritePrometheusMetrics(w)
+}
+
 // ServeRequests start the serving of requests
 func (c *WebInterface) ServeRequests() {
 
 	glog.Infof("start serving request on %s", c.ListenInterface)
 
 	http.Handle("/getStatus", httpauth.SimpleBasicAuth(c.User, c.Password)(http.HandlerFunc(c.getStatus)))
+	// prometheus scrapers without credentials are supported by disabling the authentication of /metrics
+	metrics := http.Handler(http.HandlerFunc(c.getMetrics))
+	if c.MetricsAuth {
+		metrics = httpauth.SimpleBasicAuth(c.User, c.Password)(metrics)
+	}
+	http.Handle("/metrics", metrics)
 
 	fs := http.FileServer(http.Dir("static/"))
 	http.Handle("/static/", http.StripPrefix("/static/", fs))
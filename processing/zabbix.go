@@ -0,0 +1,254 @@
+package processing
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	. "github.com/blacked/go-zabbix"
+	"github.com/golang/glog"
+)
+
+type zabbixConfigSetting struct {
+	Server         string
+	ServerPort     int
+	Host           string
+	DiscoveryKey   string
+	BaseKey        string
+	CardinalityKey string
+	SpoolKey       string
+	Disabled       bool
+}
+
+// ZabbixExporter sends discoveries and data to a zabbix server
+type ZabbixExporter struct {
+	zabbixConfig zabbixConfigSetting
+	failedSends  int64
+	skippedSends int64
+	// packets of failed deliveries are retried from the spool
+	spool *zabbixSpool
+	// retries the spooled packets after the backoff, guarded by the sendMutex
+	retryTimer *time.Timer
+}
+
+// NewZabbixExporter creates a ZabbixExporter instance, the server may contain a port like "zabbix:10052",
+// the default is the trapper port 10051
+func NewZabbixExporter(cfg Configuration) *ZabbixExporter {
+	server := cfg.ZabbixServer
+	port := 10051
+	if host, portString, err := net.SplitHostPort(server); err == nil {
+		if portNumber, err := strconv.Atoi(portString); err == nil {
+			server = host
+			port = portNumber
+		}
+	}
+	spool, err := newZabbixSpool(cfg.ZabbixSpoolSize, cfg.ZabbixSpoolDir, cfg.ZabbixRetryBackoff)
+	if err != nil {
+		glog.Fatalf("unable to open zabbix spool directory %s: %s", cfg.ZabbixSpoolDir, err.Error())
+	}
+	return &ZabbixExporter{
+		zabbixConfig: zabbixConfigSetting{
+			Server:         server,
+			ServerPort:     port,
+			Host:           cfg.ZabbixHost,
+			DiscoveryKey:   "apache.discovery",
+			BaseKey:        "apache.acc",
+			CardinalityKey: "apache.cardinality",
+			SpoolKey:       "apache.spool",
+			Disabled:       cfg.ZabbixSendDisabled,
+		},
+		spool: spool,
+	}
+}
+
+// Name returns the name of the exporter
+func (c *ZabbixExporter) Name() string {
+	return "zabbix"
+}
+
+// SetDisabled Disables or Enables the submission of zabbix statistics
+func (c *ZabbixExporter) SetDisabled(disable bool) {
+	c.zabbixConfig.Disabled = disable
+}
+
+// GetFailedSends Returns the number of failed zabbix data deliveries
+func (c *ZabbixExporter) GetFailedSends() int64 {
+	return atomic.LoadInt64(&c.failedSends)
+}
+
+// GetSkippedSends Returns the number of zabbix data deliveries which were spooled without a attempt
+// because the retry backoff of the spooled packets was pending, they are included in the failed deliveries
+func (c *ZabbixExporter) GetSkippedSends() int64 {
+	return atomic.LoadInt64(&c.skippedSends)
+}
+
+// GetSpoolStatus Returns the number and the age of the spooled packets
+func (c *ZabbixExporter) GetSpoolStatus() ZabbixSpoolStatus {
+	return c.spool.status(time.Now())
+}
+
+// SendDiscovery sends the low level discovery of vhosts and accounting sets
+func (c *ZabbixExporter) SendDiscovery(snapshot *StatsSnapshot) {
+	if c.zabbixConfig.Disabled {
+		glog.V(1).Info("Zabbix sender disabled, not sending data")
+		return
+	}
+	glog.Info("Sending discovery")
+
+	var discoveryDataArray []map[string]string
+
+	for vhost, vhostData := range snapshot.Stats {
+		for accset := range vhostData {
+			discoveryItem := map[string]string{
+				"{#NAME}":   vhost,
+				"{#ACCSET}": accset,
+			}
+			discoveryDataArray = append(discoveryDataArray, discoveryItem)
+		}
+	}
+	jsonString, err := json.Marshal(discoveryDataArray)
+	if err != nil {
+		glog.Fatalf("unable to marshal json discovery data: %s", err.Error())
+	}
+	glog.Infof("sending discovery data >>>%s<<<", string(jsonString))
+	var metrics []*Metric
+	metrics = append(metrics, NewMetric(c.zabbixConfig.Host, c.zabbixConfig.DiscoveryKey, string(jsonString), snapshot.Time.Unix()))
+	c.sendZabbixMetrics(metrics)
+}
+
+func (c *ZabbixExporter) sendPacket(metrics []*Metric) error {
+	packet := NewPacket(metrics)
+	z := NewSender(c.zabbixConfig.Server, c.zabbixConfig.ServerPort)
+	res, err := z.Send(packet)
+	if err != nil {
+		return fmt.Errorf("%s - >>>%s<<<", err.Error(), res)
+	}
+	return nil
+}
+
+// sendZabbixMetrics delivers the metrics after the spooled packets, the metrics are spooled
+// if the delivery fails or the spool is not empty to keep the order of the packets,
+// the caller holds the sendMutex
+func (c *ZabbixExporter) sendZabbixMetrics(metrics []*Metric) {
+	if c.zabbixConfig.Disabled {
+		glog.Info("Zabbix sender disabled, not sending data")
+		return
+	}
+	now := time.Now()
+	if flushed, err := c.spool.flush(now, c.sendPacket); !flushed {
+		if err == nil {
+			// the delivery is skipped until the backoff expired
+			atomic.AddInt64(&c.skippedSends, 1)
+		}
+		glog.Infof("spooling zabbix packet until the spooled packets are delivered")
+		atomic.AddInt64(&c.failedSends, 1)
+		c.spool.add(metrics, now)
+		c.scheduleRetry(now)
+		return
+	}
+	if err := c.sendPacket(metrics); err != nil {
+		glog.Errorf("unable to send zabbix packet, spooling it : '%s'", err.Error())
+		atomic.AddInt64(&c.failedSends, 1)
+		c.spool.add(metrics, now)
+		c.spool.failed(now)
+		c.scheduleRetry(now)
+	}
+}
+
+// scheduleRetry retries the spooled packets when the backoff expired, this delivers them
+// even if no further statistics are sent, the caller holds the sendMutex
+func (c *ZabbixExporter) scheduleRetry(now time.Time) {
+	if c.retryTimer != nil {
+		c.retryTimer.Stop()
+	}
+	c.retryTimer = time.AfterFunc(c.spool.retryDelay(now), c.retrySpool)
+}
+
+func (c *ZabbixExporter) retrySpool() {
+	sendMutex.Lock()
+	defer sendMutex.Unlock()
+	if c.zabbixConfig.Disabled {
+		return
+	}
+	now := time.Now()
+	if flushed, _ := c.spool.flush(now, c.sendPacket); !flushed {
+		c.scheduleRetry(now)
+	}
+}
+
+func (c *ZabbixExporter) createZabbixMetric(dataTime int64, value string, keys ...string) *Metric {
+	key := fmt.Sprintf("%s[%s]", c.zabbixConfig.BaseKey, strings.Join(keys, ","))
+	glog.V(1).Infof("Creating metric : %s = %s", key, value)
+	return NewMetric(c.zabbixConfig.Host, key, string(value), dataTime)
+}
+
+// SendData sends the statistics of the snapshot
+func (c *ZabbixExporter) SendData(snapshot *StatsSnapshot) {
+	if c.zabbixConfig.Disabled {
+		glog.V(1).Info("Zabbix sender disabled, not sending data")
+		return
+	}
+	glog.Info("Sending data")
+	var metrics []*Metric
+
+	dataTime := snapshot.Time.Unix()
+
+	for vhost, vhostData := range snapshot.Stats {
+		for accset, accsetData := range vhostData {
+			metrics = append(metrics, c.createZabbixMetric(dataTime, strconv.FormatInt(accsetData.Count, 10), vhost, accset, "count"))
+			metrics = append(metrics, c.createZabbixMetric(dataTime, strconv.FormatInt(accsetData.Sum, 10), vhost, accset, "sum"))
+			metrics = append(metrics, c.createZabbixMetric(dataTime, strconv.FormatInt(accsetData.Requests, 10), vhost, accset, "requests"))
+			metrics = append(metrics, c.createZabbixMetric(dataTime, strconv.FormatInt(accsetData.Errors, 10), vhost, accset, "errors"))
+
+			/*
+			 * Differential statistics of the sending interval
+			 */
+			metrics = append(metrics, c.createZabbixMetric(dataTime, fmt.Sprintf("%f", accsetData.Interval.RequestsPerSecond), vhost, accset, "req_s"))
+			metrics = append(metrics, c.createZabbixMetric(dataTime, fmt.Sprintf("%f", accsetData.Interval.Average), vhost, accset, "avg"))
+			metrics = append(metrics, c.createZabbixMetric(dataTime, fmt.Sprintf("%f", accsetData.Interval.ErrorRatio), vhost, accset, "error_ratio"))
+
+			for class, count := range accsetData.Classes {
+				metrics = append(metrics, c.createZabbixMetric(dataTime, strconv.FormatInt(count, 10), vhost, accset, "class", fmt.Sprintf("%d", class)))
+			}
+
+			for code, count := range accsetData.Codes {
+				metrics = append(metrics, c.createZabbixMetric(dataTime, strconv.FormatInt(count, 10), vhost, accset, "code", fmt.Sprintf("%d", code)))
+			}
+
+			for codeClass, count := range accsetData.CodeClasses {
+				metrics = append(metrics, c.createZabbixMetric(dataTime, strconv.FormatInt(count, 10), vhost, accset, "codeclass", codeClass))
+			}
+
+			metrics = append(metrics, c.createZabbixMetric(dataTime, strconv.FormatInt(accsetData.Interval.Count, 10), vhost, accset, "interval", "count"))
+			metrics = append(metrics, c.createZabbixMetric(dataTime, strconv.FormatInt(accsetData.Interval.Sum, 10), vhost, accset, "interval", "sum"))
+			metrics = append(metrics, c.createZabbixMetric(dataTime, strconv.FormatInt(accsetData.Interval.Max, 10), vhost, accset, "interval", "max"))
+			for class, count := range accsetData.Interval.Classes {
+				metrics = append(metrics, c.createZabbixMetric(dataTime, strconv.FormatInt(count, 10), vhost, accset, "interval", "class", fmt.Sprintf("%d", class)))
+			}
+			metrics = append(metrics, c.createZabbixMetric(dataTime, strconv.FormatInt(accsetData.Interval.Requests, 10), vhost, accset, "interval", "requests"))
+			metrics = append(metrics, c.createZabbixMetric(dataTime, strconv.FormatInt(accsetData.Interval.Errors, 10), vhost, accset, "interval", "errors"))
+			for code, count := range accsetData.Interval.Codes {
+				metrics = append(metrics, c.createZabbixMetric(dataTime, strconv.FormatInt(count, 10), vhost, accset, "interval", "code", fmt.Sprintf("%d", code)))
+			}
+			for codeClass, count := range accsetData.Interval.CodeClasses {
+				metrics = append(metrics, c.createZabbixMetric(dataTime, strconv.FormatInt(count, 10), vhost, accset, "interval", "codeclass", codeClass))
+			}
+
+			for name, value := range accsetData.Percentiles {
+				metrics = append(metrics, c.createZabbixMetric(dataTime, strconv.FormatInt(value, 10), vhost, accset, name))
+			}
+		}
+	}
+	metrics = append(metrics, NewMetric(c.zabbixConfig.Host, c.zabbixConfig.CardinalityKey+"[dropped]", strconv.FormatInt(snapshot.Dropped, 10), dataTime))
+	metrics = append(metrics, NewMetric(c.zabbixConfig.Host, c.zabbixConfig.CardinalityKey+"[folded]", strconv.FormatInt(snapshot.Folded, 10), dataTime))
+	// self monitoring of the delivery, the values are sent with the packet even if it is spooled
+	spoolStatus := c.GetSpoolStatus()
+	metrics = append(metrics, NewMetric(c.zabbixConfig.Host, c.zabbixConfig.SpoolKey+"[packets]", strconv.Itoa(spoolStatus.Packets), dataTime))
+	metrics = append(metrics, NewMetric(c.zabbixConfig.Host, c.zabbixConfig.SpoolKey+"[age]", fmt.Sprintf("%f", spoolStatus.Age.Seconds()), dataTime))
+	metrics = append(metrics, NewMetric(c.zabbixConfig.Host, c.zabbixConfig.SpoolKey+"[dropped]", strconv.FormatInt(spoolStatus.Dropped, 10), dataTime))
+	c.sendZabbixMetrics(metrics)
+}
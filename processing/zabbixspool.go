@@ -0,0 +1,212 @@
+package processing
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/blacked/go-zabbix"
+	"github.com/golang/glog"
+)
+
+const zabbixSpoolVersion = 1
+
+// zabbixMaxRetryBackoff limits the exponential backoff of the retries
+const zabbixMaxRetryBackoff = 10 * time.Minute
+
+// ZabbixSpoolStatus describes the packets which were not delivered to zabbix yet
+type ZabbixSpoolStatus struct {
+	Packets int
+	// Age of the oldest packet
+	Age time.Duration
+	// Dropped counts the packets which were discarded because the spool was full
+	Dropped int64
+}
+
+type spooledPacket struct {
+	Version int       `json:"version"`
+	Created time.Time `json:"created"`
+	Metrics []*Metric `json:"metrics"`
+	// the file of the packet in the spool directory
+	file string
+}
+
+// zabbixSpool keeps the packets of failed zabbix deliveries in memory and optionally in a directory,
+// the packets are retried with a exponential backoff and delivered in the order of their creation
+type zabbixSpool struct {
+	mutex      sync.Mutex
+	maxPackets int
+	dir        string
+	backoff    time.Duration
+	packets    []*spooledPacket
+	sequence   int64
+	dropped    int64
+	failures   int
+	nextRetry  time.Time
+}
+
+func newZabbixSpool(maxPackets int, dir string, backoff time.Duration) (*zabbixSpool, error) {
+	spool := &zabbixSpool{
+		maxPackets: maxPackets,
+		dir:        dir,
+		backoff:    backoff,
+	}
+	if dir == "" {
+		return spool, nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	// the zero padded sequence numbers of the filenames define the order of the packets
+	sort.Strings(files)
+	for _, file := range files {
+		sequence, err := strconv.ParseInt(strings.TrimSuffix(filepath.Base(file), ".json"), 10, 64)
+		if err != nil {
+			continue
+		}
+		if sequence >= spool.sequence {
+			spool.sequence = sequence + 1
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		packet := &spooledPacket{}
+		if err = json.Unmarshal(data, packet); err != nil || packet.Version != zabbixSpoolVersion {
+			glog.Errorf("discarding invalid zabbix spool file %s", file)
+			os.Remove(file)
+			continue
+		}
+		packet.file = file
+		spool.packets = append(spool.packets, packet)
+	}
+	spool.limit()
+	if len(spool.packets) > 0 {
+		glog.Infof("loaded %d undelivered zabbix packets from spool directory %s", len(spool.packets), dir)
+	}
+	return spool, nil
+}
+
+// add appends a packet which was not delivered, the oldest packets are dropped when the spool is full
+func (c *zabbixSpool) add(metrics []*Metric, created time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.maxPackets <= 0 {
+		// spooling is disabled, the packet is lost
+		c.dropped++
+		return
+	}
+	packet := &spooledPacket{Version: zabbixSpoolVersion, Created: created, Metrics: metrics}
+	if c.dir != "" {
+		packet.file = filepath.Join(c.dir, fmt.Sprintf("%020d.json", c.sequence))
+		c.sequence++
+		data, err := json.Marshal(packet)
+		if err != nil {
+			glog.Fatalf("unable to marshal zabbix packet: %s", err.Error())
+		}
+		if err = WriteFileAtomic(packet.file, data); err != nil {
+			glog.Errorf("unable to write zabbix spool file %s: %s", packet.file, err.Error())
+			packet.file = ""
+		}
+	}
+	c.packets = append(c.packets, packet)
+	c.limit()
+}
+
+// limit drops the oldest packets exceeding the size of the spool, the caller holds the mutex
+func (c *zabbixSpool) limit() {
+	for len(c.packets) > 0 && len(c.packets) > c.maxPackets {
+		glog.Errorf("zabbix spool is full, dropping packet of %s with %d metrics", c.packets[0].Created.Format(time.RFC3339), len(c.packets[0].Metrics))
+		c.remove()
+		c.dropped++
+	}
+}
+
+// remove removes the oldest packet, the caller holds the mutex
+func (c *zabbixSpool) remove() {
+	if c.packets[0].file != "" {
+		os.Remove(c.packets[0].file)
+	}
+	c.packets[0] = nil
+	c.packets = c.packets[1:]
+}
+
+// failed delays the next retry by the backoff, which doubles with every failed delivery
+func (c *zabbixSpool) failed(now time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	backoff := c.backoff
+	for i := 0; i < c.failures && backoff < zabbixMaxRetryBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > zabbixMaxRetryBackoff {
+		backoff = zabbixMaxRetryBackoff
+	}
+	c.failures++
+	c.nextRetry = now.Add(backoff)
+	glog.Infof("retrying zabbix delivery of %d spooled packets in %s", len(c.packets), backoff)
+}
+
+// retryDelay returns the time until the backoff of the next retry expired
+func (c *zabbixSpool) retryDelay(now time.Time) time.Duration {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if delay := c.nextRetry.Sub(now); delay > 0 {
+		return delay
+	}
+	return 0
+}
+
+// flush delivers the spooled packets in order, it returns false if packets are left in the spool and
+// the error of the failed delivery, no error is returned if the delivery was skipped because the backoff is pending,
+// the packets are delivered outside of the mutex, concurrent flushes are prevented by the sendMutex
+func (c *zabbixSpool) flush(now time.Time, send func(metrics []*Metric) error) (bool, error) {
+	c.mutex.Lock()
+	if len(c.packets) > 0 && now.Before(c.nextRetry) {
+		c.mutex.Unlock()
+		return false, nil
+	}
+	c.mutex.Unlock()
+	for {
+		c.mutex.Lock()
+		if len(c.packets) == 0 {
+			c.failures = 0
+			c.mutex.Unlock()
+			return true, nil
+		}
+		packet := c.packets[0]
+		c.mutex.Unlock()
+
+		if err := send(packet.Metrics); err != nil {
+			glog.Errorf("unable to deliver spooled zabbix packet of %s: %s", packet.Created.Format(time.RFC3339), err.Error())
+			c.failed(now)
+			return false, err
+		}
+		glog.V(1).Infof("delivered spooled zabbix packet of %s", packet.Created.Format(time.RFC3339))
+		c.mutex.Lock()
+		if len(c.packets) > 0 && c.packets[0] == packet {
+			c.remove()
+		}
+		c.mutex.Unlock()
+	}
+}
+
+func (c *zabbixSpool) status(now time.Time) ZabbixSpoolStatus {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	status := ZabbixSpoolStatus{Packets: len(c.packets), Dropped: c.dropped}
+	if len(c.packets) > 0 {
+		status.Age = now.Sub(c.packets[0].Created)
+	}
+	return status
+}
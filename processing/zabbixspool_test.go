@@ -0,0 +1,182 @@
+package processing_test
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"256bit.org/apache_logpipe/processing"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeTrapper receives zabbix sender packets and records their first keys
+type fakeTrapper struct {
+	listener net.Listener
+	mutex    sync.Mutex
+	keys     []string
+}
+
+func startFakeTrapper(t *testing.T, address string) *fakeTrapper {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		t.Fatalf("unable to listen on %s: %s", address, err.Error())
+	}
+	trapper := &fakeTrapper{listener: listener}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			trapper.handle(conn)
+		}
+	}()
+	return trapper
+}
+
+func (c *fakeTrapper) handle(conn net.Conn) {
+	defer conn.Close()
+	header := make([]byte, 13)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return
+	}
+	body := make([]byte, binary.LittleEndian.Uint64(header[5:]))
+	if _, err := io.ReadFull(conn, body); err != nil {
+		return
+	}
+	var packet struct {
+		Data []struct {
+			Key string `json:"key"`
+		} `json:"data"`
+	}
+	json.Unmarshal(body, &packet)
+	c.mutex.Lock()
+	c.keys = append(c.keys, packet.Data[0].Key)
+	c.mutex.Unlock()
+	conn.Write([]byte("ZBXD\x01"))
+}
+
+func (c *fakeTrapper) receivedKeys() []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([]string{}, c.keys...)
+}
+
+// unusedAddress returns a local address which refuses connections
+func unusedAddress(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %s", err.Error())
+	}
+	listener.Close()
+	return listener.Addr().String()
+}
+
+func TestZabbixSpoolRetry(t *testing.T) {
+	assert := assert.New(t)
+	address := unusedAddress(t)
+	cfg := processing.NewConfiguration()
+	cfg.ZabbixServer = address
+	cfg.ZabbixRetryBackoff = time.Millisecond
+	requestAccounting := processing.NewRequestAccounting(*cfg)
+	processing.CompleteStream()
+	<-processing.CompleteChan
+
+	requestAccounting.AccountRequest("dom1", "/foo", "100", 200)
+	time.Sleep(10 * time.Millisecond)
+	requestAccounting.SubmitData()
+	assert.Equal(int64(4), requestAccounting.GetFailedZabbixSends())
+	status := requestAccounting.GetZabbixSpoolStatus()
+	assert.Equal(4, status.Packets)
+	assert.True(status.Age > 0)
+
+	trapper := startFakeTrapper(t, address)
+	defer trapper.listener.Close()
+	time.Sleep(10 * time.Millisecond)
+	requestAccounting.SubmitData()
+
+	keys := trapper.receivedKeys()
+	assert.Len(keys, 6, "the spooled packets are flushed before the new ones")
+	for i, key := range keys {
+		if i%2 == 0 {
+			assert.Equal("apache.discovery", key, "the packets are delivered in order")
+		} else {
+			assert.NotEqual("apache.discovery", key, "the packets are delivered in order")
+		}
+	}
+	assert.Equal(processing.ZabbixSpoolStatus{}, requestAccounting.GetZabbixSpoolStatus())
+}
+
+func TestZabbixSpoolBackoffAndLimit(t *testing.T) {
+	assert := assert.New(t)
+	address := unusedAddress(t)
+	cfg := processing.NewConfiguration()
+	cfg.ZabbixServer = address
+	cfg.ZabbixSpoolSize = 3
+	cfg.ZabbixRetryBackoff = time.Hour
+	requestAccounting := processing.NewRequestAccounting(*cfg)
+	processing.CompleteStream()
+	<-processing.CompleteChan
+
+	trapper := startFakeTrapper(t, address)
+	defer trapper.listener.Close()
+	requestAccounting.SubmitData()
+
+	assert.Empty(trapper.receivedKeys(), "no delivery before the backoff expired")
+	assert.Equal(int64(4), requestAccounting.GetFailedZabbixSends())
+	assert.Equal(int64(3), requestAccounting.GetSkippedZabbixSends(), "the deliveries after the first failure wait for the backoff")
+	status := requestAccounting.GetZabbixSpoolStatus()
+	assert.Equal(3, status.Packets)
+	assert.Equal(int64(1), status.Dropped, "the oldest packet is dropped")
+}
+
+func TestZabbixSpoolRetryTimer(t *testing.T) {
+	assert := assert.New(t)
+	address := unusedAddress(t)
+	cfg := processing.NewConfiguration()
+	cfg.ZabbixServer = address
+	cfg.ZabbixRetryBackoff = 10 * time.Millisecond
+	requestAccounting := processing.NewRequestAccounting(*cfg)
+	processing.CompleteStream()
+	<-processing.CompleteChan
+	assert.Equal(2, requestAccounting.GetZabbixSpoolStatus().Packets)
+
+	trapper := startFakeTrapper(t, address)
+	defer trapper.listener.Close()
+	assert.Eventually(func() bool {
+		return len(trapper.receivedKeys()) == 2
+	}, 5*time.Second, 10*time.Millisecond, "the spooled packets are delivered without further sends")
+	assert.Equal(0, requestAccounting.GetZabbixSpoolStatus().Packets)
+}
+
+func TestZabbixSpoolDirectory(t *testing.T) {
+	assert := assert.New(t)
+	testDir := SetupLogfileTestDir()
+	defer RemoveTestDir(testDir)
+	address := unusedAddress(t)
+	cfg := processing.NewConfiguration()
+	cfg.ZabbixServer = address
+	cfg.ZabbixSpoolDir = testDir + "/spool"
+	processing.NewRequestAccounting(*cfg)
+	processing.CompleteStream()
+	<-processing.CompleteChan
+
+	files, _ := filepath.Glob(cfg.ZabbixSpoolDir + "/*.json")
+	assert.Len(files, 2, "discovery and data are spooled on disk")
+
+	trapper := startFakeTrapper(t, address)
+	defer trapper.listener.Close()
+	requestAccounting := processing.NewRequestAccounting(*cfg)
+	assert.Equal(2, requestAccounting.GetZabbixSpoolStatus().Packets, "the spool survives restarts")
+	processing.CompleteStream()
+	<-processing.CompleteChan
+
+	assert.Len(trapper.receivedKeys(), 4)
+	files, _ = filepath.Glob(cfg.ZabbixSpoolDir + "/*.json")
+	assert.Empty(files)
+}